@@ -0,0 +1,126 @@
+// Package accesslog writes one record per tunneled stream.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Close reasons.
+const (
+	Completed     = "completed"
+	DialFailed    = "dial-failed"
+	NoSession     = "no-session"
+	HeaderFailed  = "header-failed"
+	ProxyFailed   = "proxy-protocol-failed"
+	SessionFailed = "session-failed"
+)
+
+// Record describes one stream, from the point of view of one side.
+type Record struct {
+	// Side is "listen" on the side accepting the connection, "dial" on the
+	// side connecting to the target.
+	Side     string `json:"side"`
+	Session  string `json:"session"`
+	Peer     string `json:"peer"`
+	Stream   string `json:"stream"`
+	Listener string `json:"listener,omitempty"`
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // seconds
+
+	// BytesIn flows from the source to the target, BytesOut the other way.
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+
+	CloseReason string `json:"closeReason"`
+}
+
+var (
+	sinkSpec string
+
+	sink      io.Writer
+	sinkMutex = sync.Mutex{}
+)
+
+func RegisterFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&sinkSpec, "access-log", "", "Access log sink (stdout, stderr, file:<path>, syslog or syslog:<proto>://<addr>)")
+}
+
+// Open opens the sink given by the flags. It does nothing if no sink is set.
+func Open() (err error) {
+	if sinkSpec == "" {
+		return
+	}
+
+	w, err := openSink(sinkSpec)
+	if err != nil {
+		return
+	}
+
+	sinkMutex.Lock()
+	sink = w
+	sinkMutex.Unlock()
+	return
+}
+
+func openSink(spec string) (io.Writer, error) {
+	switch {
+	case spec == "stdout":
+		return os.Stdout, nil
+
+	case spec == "stderr":
+		return os.Stderr, nil
+
+	case strings.HasPrefix(spec, "file:"):
+		return os.OpenFile(strings.TrimPrefix(spec, "file:"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+
+	case spec == "syslog":
+		return openSyslog("", "")
+
+	case strings.HasPrefix(spec, "syslog:"):
+		parts := strings.SplitN(strings.TrimPrefix(spec, "syslog:"), "://", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid syslog access log: %q", spec)
+		}
+		return openSyslog(parts[0], parts[1])
+
+	default:
+		return nil, fmt.Errorf("invalid access log: %q", spec)
+	}
+}
+
+// Enabled tells if records are written somewhere.
+func Enabled() bool {
+	sinkMutex.Lock()
+	defer sinkMutex.Unlock()
+	return sink != nil
+}
+
+// Log writes the record, setting its duration from its start time.
+func Log(r *Record) {
+	sinkMutex.Lock()
+	defer sinkMutex.Unlock()
+
+	if sink == nil {
+		return
+	}
+
+	r.Duration = time.Since(r.Start).Seconds()
+
+	ba, err := json.Marshal(r)
+	if err != nil {
+		panic(err) // Record is always marshalable
+	}
+
+	sink.Write(append(ba, '\n'))
+}
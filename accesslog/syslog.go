@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to syslog, the local one if network is empty.
+func openSyslog(network, raddr string) (io.Writer, error) {
+	return syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "kgate")
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mcluseau/kgate/common"
+	"github.com/mcluseau/kgate/logging"
+)
+
+var (
+	adminBindSpec = ""
+	adminToken    = ""
+)
+
+// startAdmin serves the admin API if enabled.
+func startAdmin(cfg *config) {
+	if adminBindSpec == "" {
+		return
+	}
+
+	if adminToken == "" {
+		adminToken = os.Getenv("KGATE_ADMIN_TOKEN")
+	}
+	if adminToken == "" {
+		logging.Fatal("an admin token is required (--admin-token or KGATE_ADMIN_TOKEN)")
+	}
+
+	l, err := common.Listen(adminBindSpec, "0600")
+	if err != nil {
+		logging.Fatal("failed to listen for the admin API", "listener", adminBindSpec, "error", err)
+	}
+
+	logging.Info("admin API listening", "listener", adminBindSpec)
+
+	go func() {
+		err := http.Serve(l, adminHandler(cfg))
+		logging.Fatal("admin API failed", "error", err)
+	}()
+}
+
+func adminHandler(cfg *config) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"gateway":   cfg.url(),
+			"session":   common.Session(),
+			"listeners": len(common.Listeners()),
+			"streams":   len(common.Streams()),
+		})
+	})
+
+	mux.HandleFunc("/listeners", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, common.Listeners())
+
+		case http.MethodPost:
+			listener := &common.Listener{}
+			if err := json.NewDecoder(r.Body).Decode(listener); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err := common.AddListener(listener); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.WriteHeader(http.StatusCreated)
+
+		case http.MethodDelete:
+			if err := common.RemoveListener(r.URL.Query().Get("listen")); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/streams", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, common.Streams())
+	})
+
+	mux.HandleFunc("/streams/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !common.KillStream(strings.TrimPrefix(r.URL.Path, "/streams/")) {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/reconnect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !common.CloseSession() {
+			http.Error(w, "no active session", http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		common.WriteMetrics(w)
+	})
+
+	return requireToken(mux)
+}
+
+func requireToken(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + adminToken)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
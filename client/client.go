@@ -4,12 +4,13 @@ import (
 	"archive/zip"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,13 +20,17 @@ import (
 	"golang.org/x/net/websocket"
 
 	"github.com/mcluseau/kgate/common"
+	kconfig "github.com/mcluseau/kgate/config"
+	"github.com/mcluseau/kgate/logging"
+	"github.com/mcluseau/kgate/passphrase"
+	"github.com/mcluseau/kgate/pki"
 )
 
 var (
 	dialTimeout = 10 * time.Second
 
 	bindSpec       = "127.0.0.1:1080"
-	gateway        = "ws://localhost:1081"
+	gateways       = []string{"ws://localhost:1081"}
 	proxyUrl       = ""
 	safeServerName = "localhost"
 	tlsKey         = "client.key"
@@ -34,6 +39,8 @@ var (
 
 	rootCAs = x509.NewCertPool()
 
+	passphraseSource = passphrase.Source{Agent: os.Getenv(passphrase.AgentEnvVar)}
+
 	remote *yamux.Session
 )
 
@@ -45,22 +52,41 @@ func Command() *cobra.Command {
 
 	flags := cmd.Flags()
 	flags.StringVar(&bindSpec, "bind", bindSpec, "Bind address")
-	flags.StringVar(&gateway, "gw", gateway, "WebSocket gateway URL")
+	flags.StringSliceVar(&gateways, "gw", gateways, "Gateway URLs, tried in order (ws:// or wss:// for websocket, tls:// for raw TLS)")
 	flags.StringVar(&proxyUrl, "proxy", proxyUrl, "Proxy to reach the gateway")
 	flags.StringVar(&safeServerName, "safe-server-name", safeServerName, "Server name for the safe tunnel")
-	flags.StringVar(&tlsKey, "key", tlsKey, "Key for TLS auth")
+	flags.StringVar(&tlsKey, "key", tlsKey, "Key for TLS auth (also used with a config file without key, from enroll)")
 	flags.StringVar(&tlsCert, "crt", tlsCert, "Certificate for TLS auth")
 	flags.StringVar(&caCertFile, "ca", caCertFile, "CA certificate for TLS auth")
+	flags.StringVar(&passphraseSource.File, "passphrase-file", "", "File containing the passphrase of an encrypted config file")
+	flags.StringVar(&passphraseSource.Agent, "passphrase-agent", passphraseSource.Agent, "Agent socket giving the passphrase of an encrypted config file (defaults to the "+passphrase.AgentEnvVar+" env)")
+	flags.StringVar(&adminBindSpec, "admin", adminBindSpec, "Admin API listen spec (ie 127.0.0.1:1082 or unix:/path), disabled if empty")
+	flags.StringVar(&adminToken, "admin-token", adminToken, "Admin API bearer token (defaults to the KGATE_ADMIN_TOKEN env)")
+	registerProfileFlags(flags)
+	registerPushedFlags(flags)
 	common.RegisterFlags(flags)
+	common.RegisterCertificateFlags(flags)
+
+	cmd.AddCommand(enrollCommand())
 
 	return cmd
 }
 
 type config struct {
-	url            string
+	urls           []string
 	safeServerName string
 	caBytes        []byte
 	certificate    tls.Certificate
+
+	// transfers are local transfers started along with the flags' ones.
+	transfers *kconfig.Config
+
+	current int32 // index of the current URL
+}
+
+// url returns the current gateway URL.
+func (cfg *config) url() string {
+	return cfg.urls[atomic.LoadInt32(&cfg.current)]
 }
 
 func run(cmd *cobra.Command, args []string) {
@@ -74,35 +100,77 @@ func run(cmd *cobra.Command, args []string) {
 
 	cfg := &config{}
 
-	if len(args) == 0 {
+	switch {
+	case profileName != "":
+		if len(args) != 0 {
+			logging.Fatal("a profile and a config file can't be used together")
+		}
+		loadConfigFromProfile(cmd.Flags(), cfg)
+
+	case len(args) == 0:
 		loadConfigFromArgs(cfg)
 
-	} else {
+	default:
 		loadConfigFromZip(args[0], cfg)
 	}
 
+	recordCertificates(cfg)
+	common.StartExpiryChecks()
+
 	common.StartListeners()
+	startTransfers(cfg)
+	startAdmin(cfg)
+
+	if acceptPushed {
+		common.ControlHandler = reconcilePushed
+	}
 
 	for {
-		connect(cfg)
+		for i := range cfg.urls {
+			atomic.StoreInt32(&cfg.current, int32(i))
+			connect(cfg)
+		}
 
-		log.Print("retry in 5s")
+		logging.Info("retry in 5s")
 		time.Sleep(5 * time.Second)
 	}
 }
 
+// startTransfers starts the local transfers of the configuration. The -L
+// flags win on the same listen spec.
+func startTransfers(cfg *config) {
+	if cfg.transfers == nil {
+		return
+	}
+
+	started := map[string]bool{}
+	for _, listener := range common.Listeners() {
+		started[listener.Listen] = true
+	}
+
+	for _, listener := range common.ConfigListeners(cfg.transfers) {
+		if started[listener.Listen] {
+			logging.Info("transfer overridden by flags", "listener", listener.Listen)
+			continue
+		}
+		if err := common.AddListener(listener); err != nil {
+			logging.Fatal("failed to start listener", "listener", listener.Listen, "error", err)
+		}
+	}
+}
+
 func loadConfigFromArgs(cfg *config) {
 	crt, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
 	if err != nil {
-		log.Fatal("Failed to TLS auth files: ", err)
+		logging.Fatal("failed to load TLS auth files", "error", err)
 	}
 
 	caBytes, err := ioutil.ReadFile(caCertFile)
 	if err != nil {
-		log.Fatal("Failed to read CA certificate: ", err)
+		logging.Fatal("failed to read CA certificate", "error", err)
 	}
 
-	cfg.url = gateway
+	cfg.urls = gateways
 	cfg.safeServerName = safeServerName
 	cfg.caBytes = caBytes
 	cfg.certificate = crt
@@ -111,106 +179,154 @@ func loadConfigFromArgs(cfg *config) {
 func loadConfigFromZip(file string, cfg *config) {
 	zr, err := zip.OpenReader(file)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("failed to read config file", "file", file, "error", err)
 	}
 
 	defer zr.Close()
 
-	var crtPEM, keyPEM []byte
+	var crtPEM, keyPEM, encKeyPEM []byte
 
 	for _, f := range zr.File {
 		zf, err := f.Open()
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal("failed to read config file", "file", file, "error", err)
 		}
 
 		data, err := ioutil.ReadAll(zf)
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal("failed to read config file", "file", file, "error", err)
 		}
 
 		switch f.Name {
 		case "url":
-			cfg.url = string(data)
+			// one URL per line
+			cfg.urls = strings.Fields(string(data))
 		case "server-name":
 			cfg.safeServerName = string(data)
 		case "client.crt":
 			crtPEM = data
 		case "client.key":
 			keyPEM = data
+		case "client.key.enc":
+			encKeyPEM = data
 		case "ca.crt":
 			cfg.caBytes = data
+		case "transfers.json":
+			cfg.transfers = &kconfig.Config{}
+			if err := json.Unmarshal(data, cfg.transfers); err != nil {
+				logging.Fatal("invalid transfers.json in config file", "file", file, "error", err)
+			}
 		}
 	}
 
-	if cfg.url == "" {
-		log.Fatal("no url in config file")
+	if len(cfg.urls) == 0 {
+		logging.Fatal("no url in config file", "file", file)
 	}
 
 	if cfg.safeServerName == "" {
-		log.Fatal("no server-name in config file")
+		logging.Fatal("no server-name in config file", "file", file)
 	}
 
 	if crtPEM == nil {
-		log.Fatal("no client.crt in config file")
+		logging.Fatal("no client.crt in config file", "file", file)
+	}
+
+	if keyPEM == nil && encKeyPEM != nil {
+		keyPEM = decryptKey(cfg, crtPEM, encKeyPEM, file)
 	}
 
 	if keyPEM == nil {
-		log.Fatal("no client.key in config file")
+		// enrolled clients keep their key out of the config file
+		keyPEM, err = ioutil.ReadFile(tlsKey)
+		if err != nil {
+			logging.Fatal("no client.key in config file, and failed to read the key", "file", file, "key", tlsKey, "error", err)
+		}
 	}
 
 	if cfg.caBytes == nil {
-		log.Fatal("no ca.crt in config file")
+		logging.Fatal("no ca.crt in config file", "file", file)
 	}
 
 	crt, err := tls.X509KeyPair(crtPEM, keyPEM)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("invalid key pair in config file", "file", file, "error", err)
 	}
 
 	cfg.certificate = crt
 }
 
+// decryptKey decrypts the key of an encrypted config file. The passphrase ID
+// is <server name>/<client name>.
+func decryptKey(cfg *config, crtPEM, encKeyPEM []byte, file string) []byte {
+	crt, err := pki.ParseCertificate(crtPEM)
+	if err != nil {
+		logging.Fatal("invalid client.crt in config file", "file", file, "error", err)
+	}
+
+	id := cfg.safeServerName + "/" + crt.Subject.CommonName
+
+	pass, err := passphraseSource.Read(id, false)
+	if err != nil {
+		logging.Fatal("failed to read the config file passphrase", "file", file, "error", err)
+	}
+
+	keyPEM, err := pki.DecryptKey(encKeyPEM, pass)
+	if err != nil {
+		logging.Fatal("failed to decrypt the key", "file", file, "error", err)
+	}
+	return keyPEM
+}
+
+// recordCertificates tracks the expiry of the configured certificates.
+func recordCertificates(cfg *config) {
+	if leaf, err := x509.ParseCertificate(cfg.certificate.Certificate[0]); err == nil {
+		common.SetCertificates("client", leaf)
+	}
+
+	cas, err := pki.ParseCertificates(cfg.caBytes)
+	if err != nil {
+		logging.Fatal("failed to parse CA certificate", "error", err)
+	}
+	common.SetCertificates("ca", cas...)
+}
+
 func connect(cfg *config) {
 	crt := cfg.certificate
 
 	if !rootCAs.AppendCertsFromPEM(cfg.caBytes) {
-		log.Print("Failed to parse CA certificate.")
+		logging.Error("failed to parse CA certificate")
 		return
 	}
 
 	var dialer proxy.Dialer = proxy.Direct
 	if proxyUrl != "" {
-		log.Print("Using proxy")
+		logging.Info("using proxy", "proxy", proxyUrl)
 		var err error
 		var url *url.URL
 		url, err = url.Parse(proxyUrl)
 		if err != nil {
-			log.Print("Can't parse proxy url: ", err)
+			logging.Error("can't parse proxy url", "error", err)
 			return
 		}
 		dialer, err = proxy.FromURL(url, dialer)
 		if err != nil {
-			log.Print("Unable to build the proxy: ", err)
+			logging.Error("unable to build the proxy", "error", err)
 			return
 		}
 	}
 
-	targetUrl, err := url.Parse(cfg.url)
-	if err != nil {
-		log.Print("invalid URL: ", cfg.url, ": ", err)
-	}
+	gatewayURL := cfg.url()
 
-	wsConfig, err := websocket.NewConfig(cfg.url, cfg.url)
+	targetUrl, err := url.Parse(gatewayURL)
 	if err != nil {
-		log.Print("failed to create WS config: ", err)
+		logging.Error("invalid URL", "url", gatewayURL, "error", err)
 		return
 	}
 
-	log.Print("Connection, stage 0... ", cfg.url)
+	logging.Info("connection, stage 0...", "url", gatewayURL)
 	conn, err := dialer.Dial("tcp", targetUrl.Host)
 	if err != nil {
-		log.Print("Connection stage 0 failed: ", err)
+		logging.Error("connection stage 0 failed", "error", err)
 		return
 	}
 	if targetUrl.Scheme == "wss" {
@@ -220,26 +336,48 @@ func connect(cfg *config) {
 		})
 	}
 
-	log.Print("Connection, stage 1...")
-	ws, err := websocket.NewClient(wsConfig, conn)
-	if err != nil {
-		log.Print("Connection stage 1 failed: ", err)
-		return
+	if targetUrl.Scheme != "tls" {
+		logging.Info("connection, stage 1...")
+
+		wsConfig, err := websocket.NewConfig(gatewayURL, gatewayURL)
+		if err != nil {
+			logging.Error("failed to create WS config", "error", err)
+			return
+		}
+
+		ws, err := websocket.NewClient(wsConfig, conn)
+		if err != nil {
+			logging.Error("connection stage 1 failed", "error", err)
+			return
+		}
+
+		conn = ws
 	}
 
-	log.Print("Connection, stage 2...")
-	safeConn := tls.Client(ws, &tls.Config{
+	logging.Info("connection, stage 2...")
+	safeConn := tls.Client(conn, &tls.Config{
 		ServerName:   cfg.safeServerName,
 		RootCAs:      rootCAs,
 		Certificates: []tls.Certificate{crt},
+		NextProtos:   []string{common.HeaderProtocol},
 	})
 
-	log.Print("Connection, stage 3...")
+	if err := safeConn.Handshake(); err != nil {
+		logging.Error("connection stage 2 failed", "error", err)
+		return
+	}
+
+	peerCert := safeConn.ConnectionState().PeerCertificates[0]
+	peer := peerCert.Subject.CommonName
+
+	common.SetCertificates("server", peerCert)
+
+	logging.Info("connection, stage 3...")
 	session, err := yamux.Client(safeConn, nil)
 	if err != nil {
-		log.Print("Connection stage 3 failed: ", err)
+		logging.Error("connection stage 3 failed", "error", err)
 		return
 	}
 
-	common.ManageSession(session)
+	common.ManageSession(session, peer, safeConn.ConnectionState().NegotiatedProtocol)
 }
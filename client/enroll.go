@@ -0,0 +1,82 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/mcluseau/kgate/logging"
+	"github.com/mcluseau/kgate/pki"
+)
+
+var (
+	enrollName   = ""
+	enrollKeyAlg = string(pki.DefaultKeyAlgorithm)
+	enrollOut    = ""
+)
+
+func enrollCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use: "enroll",
+		Run: enrollRun,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&enrollName, "name", enrollName, "Client name, as registered on the server")
+	flags.StringVar(&enrollKeyAlg, "key-algorithm", enrollKeyAlg, "Key algorithm (ecdsa-p256, ecdsa-p384, ed25519, rsa-2048, rsa-4096)")
+	flags.StringVar(&enrollOut, "out", enrollOut, "Prefix of the written .key and .csr files (the client name if empty)")
+
+	return cmd
+}
+
+func enrollRun(cmd *cobra.Command, args []string) {
+	if enrollName == "" {
+		logging.Fatal("a client name is required (--name)")
+	}
+
+	alg, err := pki.ParseKeyAlgorithm(enrollKeyAlg)
+	if err != nil {
+		logging.Fatal("invalid key algorithm", "error", err)
+	}
+
+	out := enrollOut
+	if out == "" {
+		out = enrollName
+	}
+	keyFile, csrFile := out+".key", out+".csr"
+
+	// never overwrite a key, it may be in use
+	if _, err := os.Stat(keyFile); err == nil {
+		logging.Fatal("key file already exists", "file", keyFile)
+	}
+
+	key, keyPEM, err := pki.GenerateKey(alg)
+	if err != nil {
+		logging.Fatal("failed to generate the key", "error", err)
+	}
+
+	csrPEM, err := pki.NewCSR(key, enrollName)
+	if err != nil {
+		logging.Fatal("failed to create the CSR", "error", err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		logging.Fatal("failed to write the key", "file", keyFile, "error", err)
+	}
+	if err := ioutil.WriteFile(csrFile, csrPEM, 0644); err != nil {
+		logging.Fatal("failed to write the CSR", "file", csrFile, "error", err)
+	}
+
+	logging.Info("key and CSR written", "key", keyFile, "csr", csrFile)
+
+	fmt.Printf(`Send %s to the kgate administrator, to be signed with:
+  kgatectl -n NAMESPACE enroll sign --csr %s
+or submitted for approval as a Kubernetes CertificateSigningRequest with:
+  kgatectl -n NAMESPACE enroll submit --csr %s
+
+Then connect with the returned configuration and the local key:
+  kgate client --key %s <config zip>
+`, csrFile, csrFile, csrFile, keyFile)
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+
+	kconfig "github.com/mcluseau/kgate/config"
+	"github.com/mcluseau/kgate/logging"
+)
+
+var (
+	profilesFile = defaultProfilesFile()
+	profileName  = ""
+)
+
+// profiles is the client configuration file, in YAML or JSON.
+type profiles struct {
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+// profile holds the settings of a client. Relative paths are relative to
+// the configuration file.
+type profile struct {
+	// Gateways are tried in order.
+	Gateways   []string `json:"gateways,omitempty"`
+	ServerName string   `json:"serverName,omitempty"`
+
+	// Bundle is a config zip from kgatectl, giving the gateway, server name
+	// and TLS material not set in the profile.
+	Bundle string `json:"bundle,omitempty"`
+
+	// TLS material, as inline PEM or by path.
+	CA       string `json:"ca,omitempty"`
+	CAFile   string `json:"caFile,omitempty"`
+	Cert     string `json:"cert,omitempty"`
+	CertFile string `json:"certFile,omitempty"`
+	Key      string `json:"key,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+
+	Proxy string `json:"proxy,omitempty"`
+
+	Transfers kconfig.Config `json:"transfers,omitempty"`
+
+	Bind       string `json:"bind,omitempty"`
+	Admin      string `json:"admin,omitempty"`
+	AdminToken string `json:"adminToken,omitempty"`
+}
+
+func registerProfileFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&profilesFile, "config", profilesFile, "Client configuration file, with the profiles")
+	flags.StringVar(&profileName, "profile", profileName, "Profile to use from the client configuration file")
+}
+
+func defaultProfilesFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "kgate-client.yaml"
+	}
+	return filepath.Join(dir, "kgate", "client.yaml")
+}
+
+// loadConfigFromProfile loads the selected profile. Flags given on the
+// command line override its settings.
+func loadConfigFromProfile(flags *pflag.FlagSet, cfg *config) {
+	data, err := ioutil.ReadFile(profilesFile)
+	if err != nil {
+		logging.Fatal("failed to read client configuration", "file", profilesFile, "error", err)
+	}
+
+	ps := &profiles{}
+	if err := yaml.UnmarshalStrict(data, ps); err != nil {
+		logging.Fatal("invalid client configuration", "file", profilesFile, "error", err)
+	}
+
+	p, ok := ps.Profiles[profileName]
+	if !ok || p == nil {
+		names := make([]string, 0, len(ps.Profiles))
+		for name := range ps.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		logging.Fatal("no such profile", "file", profilesFile, "profile", profileName, "profiles", names)
+	}
+
+	if p.Bundle != "" {
+		if p.KeyFile != "" {
+			tlsKey = p.path(p.KeyFile)
+		}
+		loadConfigFromZip(p.path(p.Bundle), cfg)
+	}
+
+	if len(p.Gateways) != 0 {
+		cfg.urls = p.Gateways
+	}
+	if p.ServerName != "" {
+		cfg.safeServerName = p.ServerName
+	}
+
+	if ca := p.material("ca", p.CA, p.CAFile); ca != nil {
+		cfg.caBytes = ca
+	}
+
+	crtPEM := p.material("cert", p.Cert, p.CertFile)
+	keyPEM := p.material("key", p.Key, p.KeyFile)
+
+	if crtPEM != nil || p.Bundle == "" {
+		if crtPEM == nil || keyPEM == nil {
+			logging.Fatal("the profile needs a cert and a key, or a bundle", "profile", profileName)
+		}
+
+		crt, err := tls.X509KeyPair(crtPEM, keyPEM)
+		if err != nil {
+			logging.Fatal("invalid key pair in profile", "profile", profileName, "error", err)
+		}
+		cfg.certificate = crt
+	}
+
+	cfg.transfers = mergeTransfers(cfg.transfers, &p.Transfers)
+
+	// command line flags win
+	if flags.Changed("gw") {
+		cfg.urls = gateways
+	}
+	if flags.Changed("safe-server-name") {
+		cfg.safeServerName = safeServerName
+	}
+	setUnlessChanged(flags, "proxy", &proxyUrl, p.Proxy)
+	setUnlessChanged(flags, "bind", &bindSpec, p.Bind)
+	setUnlessChanged(flags, "admin", &adminBindSpec, p.Admin)
+	setUnlessChanged(flags, "admin-token", &adminToken, p.AdminToken)
+
+	switch {
+	case len(cfg.urls) == 0:
+		logging.Fatal("no gateway in profile", "profile", profileName)
+	case cfg.safeServerName == "":
+		logging.Fatal("no server name in profile", "profile", profileName)
+	case cfg.caBytes == nil:
+		logging.Fatal("no CA in profile", "profile", profileName)
+	}
+}
+
+// mergeTransfers adds the profile's transfers to the bundle's ones, the
+// profile winning on the same listen spec.
+func mergeTransfers(bundle, profile *kconfig.Config) *kconfig.Config {
+	if bundle == nil {
+		return profile
+	}
+
+	for port, tr := range profile.LocalTransfers {
+		if bundle.LocalTransfers == nil {
+			bundle.LocalTransfers = map[int]*kconfig.TransferTarget{}
+		}
+		bundle.LocalTransfers[port] = tr
+	}
+	for listen, tr := range profile.Transfers {
+		if bundle.Transfers == nil {
+			bundle.Transfers = map[string]*kconfig.TransferTarget{}
+		}
+		bundle.Transfers[listen] = tr
+	}
+	return bundle
+}
+
+func setUnlessChanged(flags *pflag.FlagSet, flag string, v *string, value string) {
+	if value != "" && !flags.Changed(flag) {
+		*v = value
+	}
+}
+
+// path resolves a path of the profile.
+func (p *profile) path(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(profilesFile), path)
+}
+
+// material returns the inline PEM, or reads the file. It's nil if neither
+// is set.
+func (p *profile) material(name, inline, file string) []byte {
+	switch {
+	case inline != "":
+		return []byte(inline)
+
+	case file != "":
+		data, err := ioutil.ReadFile(p.path(file))
+		if err != nil {
+			logging.Fatal("failed to read profile "+name, "profile", profileName, "file", file, "error", err)
+		}
+		return data
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+
+	"github.com/mcluseau/kgate/common"
+	kconfig "github.com/mcluseau/kgate/config"
+	"github.com/mcluseau/kgate/logging"
+)
+
+var (
+	acceptPushed      = true
+	pushedListenHosts = []string{"127.0.0.1", "::1", "localhost"}
+	pushedUnixDir     = ""
+	pushedMinPort     = 1024
+	pushedMax         = 32
+
+	pushedMutex = sync.Mutex{}
+	pushed      = map[string]*common.Listener{}
+)
+
+func registerPushedFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&acceptPushed, "pushed-transfers", acceptPushed, "Start the local transfers pushed by the server")
+	flags.StringSliceVar(&pushedListenHosts, "pushed-listen-hosts", pushedListenHosts, "Hosts the pushed transfers may listen on")
+	flags.StringVar(&pushedUnixDir, "pushed-unix-dir", pushedUnixDir, "Directory of the unix sockets the pushed transfers may listen on, none if empty")
+	flags.IntVar(&pushedMinPort, "pushed-min-port", pushedMinPort, "Lowest port the pushed transfers may listen on")
+	flags.IntVar(&pushedMax, "pushed-max", pushedMax, "Maximum number of listeners of the pushed transfers, each port of a range counting as one (larger pushes are refused)")
+}
+
+// allowPushed checks a pushed transfer against the local policy.
+func allowPushed(l *common.Listener) error {
+	if strings.HasPrefix(l.Listen, "unix:") {
+		if pushedUnixDir == "" {
+			return errors.New("unix sockets not allowed")
+		}
+
+		path := filepath.Clean(strings.TrimPrefix(l.Listen, "unix:"))
+		if !strings.HasPrefix(path, filepath.Clean(pushedUnixDir)+string(filepath.Separator)) {
+			return fmt.Errorf("unix socket outside %s", pushedUnixDir)
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(l.Listen)
+	if err != nil {
+		return err
+	}
+
+	allowed := false
+	for _, h := range pushedListenHosts {
+		if h == host {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("host %q not allowed", host)
+	}
+
+	first, _, err := kconfig.ParsePortRange(port)
+	if err != nil {
+		return err
+	}
+	if first < pushedMinPort {
+		return fmt.Errorf("port below %d", pushedMinPort)
+	}
+
+	return nil
+}
+
+// reconcilePushed applies the transfers pushed by the server: stops the
+// removed or changed ones, and starts the new ones. Local transfers win on
+// the same listen spec. A push opening more than pushedMax listeners is
+// refused as a whole.
+func reconcilePushed(msg *common.ControlMessage) {
+	desired := map[string]*common.Listener{}
+	count := 0
+	for _, l := range msg.Transfers {
+		if err := allowPushed(l); err != nil {
+			logging.Warn("pushed transfer refused", "listener", l.Listen, "error", err)
+			continue
+		}
+
+		expanded, err := common.ExpandRanges(l)
+		if err != nil {
+			logging.Warn("pushed transfer refused", "listener", l.Listen, "error", err)
+			continue
+		}
+
+		count += len(expanded)
+		desired[l.Listen] = l
+	}
+
+	if count > pushedMax {
+		logging.Error("pushed transfers refused, too many listeners", "listeners", count, "max", pushedMax)
+		return
+	}
+
+	pushedMutex.Lock()
+	defer pushedMutex.Unlock()
+
+	for listen, l := range pushed {
+		if d, ok := desired[listen]; ok && reflect.DeepEqual(d, l) {
+			continue
+		}
+
+		if err := common.RemoveListener(listen); err != nil {
+			logging.Warn("failed to remove pushed transfer", "listener", listen, "error", err)
+		}
+		delete(pushed, listen)
+	}
+
+	local := map[string]bool{}
+	for _, l := range common.Listeners() {
+		local[l.Listen] = true
+	}
+
+	for listen, l := range desired {
+		if _, ok := pushed[listen]; ok {
+			continue
+		}
+
+		if local[listen] {
+			logging.Info("pushed transfer overridden by a local one", "listener", listen)
+			continue
+		}
+
+		if err := common.AddListener(l); err != nil {
+			logging.Warn("failed to start pushed transfer", "listener", listen, "error", err)
+			continue
+		}
+		pushed[listen] = l
+	}
+
+	logging.Info("pushed transfers applied", "count", len(pushed))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/mcluseau/kgate/pki"
+)
+
+const certManagerAPIVersion = "cert-manager.io/v1"
+
+func certManagerObject(kind, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	labels := map[string]interface{}{}
+	for k, v := range ownerLabels() {
+		labels[k] = v
+	}
+
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": certManagerAPIVersion,
+			"kind":       kind,
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+				"labels":    labels,
+			},
+			"spec": spec,
+		},
+	}
+}
+
+// certManagerCertificate is a certificate issued by the server's CA issuer.
+func certManagerCertificate(name, commonName string, sans []string, usages ...interface{}) *unstructured.Unstructured {
+	dnsNames, ips, uris, err := pki.SplitSANs(append([]string{commonName}, sans...))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	spec := map[string]interface{}{
+		"secretName": name,
+		"commonName": commonName,
+		"dnsNames":   stringList(dnsNames),
+		"duration":   certValidity.String(),
+		"privateKey": certManagerPrivateKey(),
+		"usages":     usages,
+		"issuerRef":  map[string]interface{}{"name": secretCA, "kind": "Issuer"},
+	}
+
+	if len(ips) != 0 {
+		list := []interface{}{}
+		for _, ip := range ips {
+			list = append(list, ip.String())
+		}
+		spec["ipAddresses"] = list
+	}
+	if len(uris) != 0 {
+		list := []interface{}{}
+		for _, uri := range uris {
+			list = append(list, uri.String())
+		}
+		spec["uris"] = list
+	}
+
+	return certManagerObject("Certificate", name, spec)
+}
+
+// certManagerPrivateKey is the private key spec for the selected algorithm.
+func certManagerPrivateKey() map[string]interface{} {
+	alg, err := pki.ParseKeyAlgorithm(keyAlgorithm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch alg {
+	case pki.ECDSAP384:
+		return map[string]interface{}{"algorithm": "ECDSA", "size": int64(384)}
+	case pki.Ed25519:
+		return map[string]interface{}{"algorithm": "Ed25519"}
+	case pki.RSA2048:
+		return map[string]interface{}{"algorithm": "RSA", "size": int64(2048)}
+	case pki.RSA4096:
+		return map[string]interface{}{"algorithm": "RSA", "size": int64(4096)}
+	default:
+		return map[string]interface{}{"algorithm": "ECDSA", "size": int64(256)}
+	}
+}
+
+func stringList(values []string) []interface{} {
+	list := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		list = append(list, v)
+	}
+	return list
+}
+
+// createCertManagerPKI renders the CA and server certificates as cert-manager
+// objects, so the secrets are issued in the cluster.
+func createCertManagerPKI() {
+	selfSigned := serverName + "-selfsigned"
+
+	for _, obj := range []*unstructured.Unstructured{
+		certManagerObject("Issuer", selfSigned, map[string]interface{}{
+			"selfSigned": map[string]interface{}{},
+		}),
+		certManagerObject("Certificate", secretCA, map[string]interface{}{
+			"isCA":       true,
+			"secretName": secretCA,
+			"commonName": serverName + " CA",
+			"duration":   caValidity.String(),
+			"privateKey": certManagerPrivateKey(),
+			"issuerRef":  map[string]interface{}{"name": selfSigned, "kind": "Issuer"},
+		}),
+		certManagerObject("Issuer", secretCA, map[string]interface{}{
+			"ca": map[string]interface{}{"secretName": secretCA},
+		}),
+		certManagerCertificate(secretServer, serverName, serverSANs, "server auth"),
+	} {
+		if err := objects.Create(obj); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mcluseau/kgate/config"
+)
+
+const (
+	// clientTransfersKey holds the standard transfers of the clients, and
+	// client.<name>.json the transfers of a single client.
+	clientTransfersKey = "transfers.json"
+
+	clientTransfersMountPath = "/client-transfers"
+)
+
+var (
+	transferListen string
+	transfersFor   string
+	socketMode     string
+)
+
+func clientTransfersCommand() *Command {
+	cmd := &Command{
+		Use: "client-transfers",
+	}
+
+	add := &Command{
+		Use: "add",
+		Run: clientTransfersAddRun,
+	}
+	remove := &Command{
+		Use: "remove",
+		Run: clientTransfersRemoveRun,
+	}
+	list := &Command{
+		Use: "list",
+		Run: clientTransfersListRun,
+	}
+
+	for _, c := range []*Command{add, remove, list} {
+		flags := c.Flags()
+		flags.StringVar(&serverName, "server-name", "kgate", "The server name")
+		flags.StringVar(&transfersFor, "client", "", "Client the transfers are pushed to by the server, all clients if empty (then also written in the config files)")
+		if c != list {
+			flags.StringVar(&transferListen, "listen", "", "Client listen spec (ie 127.0.0.1:5432, unix:/path or 127.0.0.1:5000-5049)")
+			registerOutputFlags(flags)
+		}
+	}
+
+	flags := add.Flags()
+	flags.StringVar(&remoteTarget, "target", "", "Target reached through the server (comma separated for multiple targets, with a port range matching the listen one if any)")
+	flags.StringVar(&strategy, "strategy", "", "Strategy for multiple targets (first-available, round-robin, least-connections, source-hash)")
+	flags.IntVar(&proxyProtocol, "proxy-protocol", 0, "PROXY protocol version (1 or 2) to send to the target")
+	flags.BoolVar(&acceptProxyProtocol, "accept-proxy-protocol", false, "Expect a PROXY protocol header on the client's listener")
+	flags.StringVar(&socketMode, "socket-mode", "", "File mode of a unix socket listener (ie 0660)")
+
+	cmd.AddCommand(add, remove, list)
+
+	return cmd
+}
+
+// clientTransfersConfigMap holds the transfers given to the clients, mounted
+// into the server.
+func clientTransfersConfigMap() string {
+	return serverName + "-client-transfers"
+}
+
+// clientTransfersFor returns the config map key of the client's transfers.
+func clientTransfersFor(client string) string {
+	if client == "" {
+		return clientTransfersKey
+	}
+	validateClientName(client)
+	return "client." + client + ".json"
+}
+
+func clientTransfersAddRun(cmd *Command, args []string) {
+	setupOutput()
+
+	if transferListen == "" {
+		log.Fatal("Listen spec is required")
+	}
+	if !strings.HasPrefix(transferListen, "unix:") {
+		if _, _, ok := listenPortRange(transferListen); !ok {
+			log.Fatal("Invalid listen spec: ", transferListen)
+		}
+	}
+
+	if remoteTarget == "" {
+		log.Fatal("Target is required")
+	}
+
+	if !config.ValidStrategy(strategy) {
+		log.Fatal("Invalid strategy: ", strategy)
+	}
+
+	if proxyProtocol < 0 || proxyProtocol > 2 {
+		log.Fatal("Invalid PROXY protocol version: ", proxyProtocol)
+	}
+
+	targets := strings.Split(remoteTarget, ",")
+	if err := config.ValidateRanges(transferListen, targets); err != nil {
+		log.Fatal("Invalid target: ", err)
+	}
+
+	cm, cfg, found := fetchClientTransfers(transfersFor)
+	if cfg.Transfers == nil {
+		cfg.Transfers = map[string]*config.TransferTarget{}
+	}
+	cfg.Transfers[transferListen] = &config.TransferTarget{
+		Target:   targets[0],
+		Targets:  targets[1:],
+		Strategy: strategy,
+
+		ProxyProtocol:       proxyProtocol,
+		AcceptProxyProtocol: acceptProxyProtocol,
+		SocketMode:          socketMode,
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal("Invalid client transfers: ", err)
+	}
+
+	saveClientTransfers(cm, transfersFor, cfg, found)
+}
+
+func clientTransfersRemoveRun(cmd *Command, args []string) {
+	setupOutput()
+
+	if transferListen == "" {
+		log.Fatal("Listen spec is required")
+	}
+
+	cm, cfg, found := fetchClientTransfers(transfersFor)
+	if _, ok := cfg.Transfers[transferListen]; !ok {
+		log.Fatal("No client transfer listening on ", transferListen)
+	}
+	delete(cfg.Transfers, transferListen)
+
+	saveClientTransfers(cm, transfersFor, cfg, found)
+}
+
+func clientTransfersListRun(cmd *Command, args []string) {
+	_, cfg, _ := fetchClientTransfers(transfersFor)
+
+	listens := make([]string, 0, len(cfg.Transfers))
+	for listen := range cfg.Transfers {
+		listens = append(listens, listen)
+	}
+	sort.Strings(listens)
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+
+	fmt.Fprintln(out, "LISTEN\tTARGET\tSTRATEGY")
+
+	for _, listen := range listens {
+		tr := cfg.Transfers[listen]
+		fmt.Fprintf(out, "%s\t%s\t%s\n", listen, strings.Join(tr.AllTargets(), ","), tr.Strategy)
+	}
+}
+
+// fetchClientTransfers returns the client transfers' config map, new if not
+// found, and the transfers of the client (all clients if empty).
+func fetchClientTransfers(client string) (cm *corev1.ConfigMap, cfg *config.Config, found bool) {
+	cm = &corev1.ConfigMap{}
+	err := objects.Get(clientTransfersConfigMap(), cm)
+
+	found = true
+	if errors.IsNotFound(err) {
+		found = false
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      clientTransfersConfigMap(),
+				Namespace: namespace,
+				Labels:    ownerLabels(),
+			},
+		}
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg = &config.Config{}
+	if data := cm.Data[clientTransfersFor(client)]; data != "" {
+		if err := json.Unmarshal([]byte(data), cfg); err != nil {
+			log.Fatal("failed to parse the client transfers: ", err)
+		}
+	}
+
+	return
+}
+
+func saveClientTransfers(cm *corev1.ConfigMap, client string, cfg *config.Config, found bool) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[clientTransfersFor(client)] = string(data)
+
+	if found {
+		err = objects.Update(cm)
+	} else {
+		err = objects.Create(cm)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ensureClientTransfersMount()
+}
+
+// clientTransfersManifest returns the standard client transfers, as written
+// in the configuration zips, or nil if there is none.
+func clientTransfersManifest() []byte {
+	_, cfg, _ := fetchClientTransfers("")
+	if len(cfg.Transfers) == 0 && len(cfg.LocalTransfers) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data
+}
+
+// ensureClientTransfersMount mounts the client transfers into servers
+// deployed before pushed transfers support.
+func ensureClientTransfersMount() {
+	dep, cfg := fetchConfig()
+	if addClientTransfersMount(&dep.Spec.Template.Spec) {
+		log.Print("Mounting the client transfers into ", serverName, " (will restart the server)")
+		setConfig(dep, cfg)
+	}
+}
+
+// addClientTransfersMount mounts the client transfers into the server if
+// needed, returning true if the spec changed.
+func addClientTransfersMount(spec *corev1.PodSpec) bool {
+	for _, vol := range spec.Volumes {
+		if vol.Name == "client-transfers" {
+			return false
+		}
+	}
+
+	optional := true
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "client-transfers",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: clientTransfersConfigMap()},
+				Optional:             &optional,
+			},
+		},
+	})
+
+	cnt := &spec.Containers[0]
+	cnt.VolumeMounts = append(cnt.VolumeMounts, corev1.VolumeMount{
+		Name:      "client-transfers",
+		MountPath: clientTransfersMountPath,
+		ReadOnly:  true,
+	})
+	cnt.Args = append(cnt.Args, "--client-transfers="+clientTransfersMountPath)
+
+	return true
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	k "github.com/mcluseau/kubeclient"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mcluseau/kgate/pki"
+)
+
+const (
+	// defaultClient is the client of gen-key before clients were named; its
+	// secret keeps the unsuffixed name.
+	defaultClient = "client"
+
+	clientLabel = "kgate/client"
+
+	ownerAnnotation   = "kgate/owner"
+	createdAnnotation = "kgate/created"
+	expiresAnnotation = "kgate/expires"
+	serialAnnotation  = "kgate/serial"
+
+	// serialsAnnotation lists every serial issued to the client, oldest
+	// first, so revoking it also revokes the certificates it was rotated from.
+	serialsAnnotation = "kgate/serials"
+)
+
+var (
+	clientName  string
+	clientOwner string
+
+	clientNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+func clientsCommand() *Command {
+	cmd := &Command{
+		Use: "clients",
+	}
+
+	list := &Command{
+		Use: "list",
+		Run: clientsListRun,
+	}
+
+	list.Flags().StringVar(&serverName, "server-name", "kgate", "The server name")
+
+	cmd.AddCommand(list)
+
+	return cmd
+}
+
+func validateClientName(name string) {
+	if !clientNameRegexp.MatchString(name) {
+		log.Fatal("Invalid client name (lowercase letters, digits and dashes): ", name)
+	}
+	if name == serverName {
+		// clients check the server's certificate against this name
+		log.Fatal("Invalid client name, reserved for the server: ", name)
+	}
+}
+
+func clientSecretName(name string) string {
+	if name == defaultClient {
+		return serverName + "-client"
+	}
+	return serverName + "-client-" + name
+}
+
+// getOrCreateClient returns the client's secret, issuing its certificate if
+// it doesn't exist yet.
+func getOrCreateClient(name string, caData map[string][]byte) *corev1.Secret {
+	secretName := clientSecretName(name)
+
+	sec := &corev1.Secret{}
+	err := objects.Get(secretName, sec)
+
+	if errors.IsNotFound(err) {
+		log.Print("Issuing certificate for client ", name)
+
+		sec = newTLSSecret(secretName, nil, nil)
+		sec.Labels[clientLabel] = name
+		sec.Annotations = map[string]string{
+			ownerAnnotation: clientOwner,
+		}
+
+		issueClientCertificate(sec, name, caData)
+
+		if err := objects.Create(sec); err != nil {
+			log.Fatal("failed to create secret ", secretName, ": ", err)
+		}
+
+		return sec
+
+	} else if err != nil {
+		log.Fatal("failed to fetch secret ", secretName, ": ", err)
+	}
+
+	log.Print("Client ", name, " already exists, not regenerating")
+	return sec
+}
+
+// issueClientCertificate sets a new key and certificate in the client's secret.
+func issueClientCertificate(sec *corev1.Secret, name string, caData map[string][]byte) {
+	keyPEM, crtPEM := issueCertificate(caData, name, nil, x509.ExtKeyUsageClientAuth)
+
+	sec.Data["tls.key"] = keyPEM
+	setClientCertificate(sec, crtPEM)
+}
+
+// setClientCertificate sets the certificate in the client's secret, with its
+// annotations.
+func setClientCertificate(sec *corev1.Secret, crtPEM []byte) {
+	serials := clientSerials(sec)
+
+	sec.Data["tls.crt"] = crtPEM
+
+	sec.Annotations[createdAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if crt := parseCertificatePEM(crtPEM); crt != nil {
+		sec.Annotations[expiresAnnotation] = crt.NotAfter.UTC().Format(time.RFC3339)
+		sec.Annotations[serialAnnotation] = crt.SerialNumber.Text(16)
+		serials = appendSerial(serials, crt.SerialNumber.Text(16))
+	}
+	if len(serials) != 0 {
+		sec.Annotations[serialsAnnotation] = strings.Join(serials, " ")
+	}
+}
+
+// clientSerials returns the serials issued to the client, the current one
+// included (the only one known for secrets issued before the history).
+func clientSerials(sec *corev1.Secret) []string {
+	serials := strings.Fields(sec.Annotations[serialsAnnotation])
+	if crt := parseCertificatePEM(sec.Data["tls.crt"]); crt != nil {
+		serials = appendSerial(serials, crt.SerialNumber.Text(16))
+	}
+	return serials
+}
+
+func appendSerial(serials []string, serial string) []string {
+	for _, s := range serials {
+		if s == serial {
+			return serials
+		}
+	}
+	return append(serials, serial)
+}
+
+func parseCertificatePEM(crtPEM []byte) *x509.Certificate {
+	crt, err := pki.ParseCertificate(crtPEM)
+	if err != nil {
+		return nil
+	}
+	return crt
+}
+
+// clientSecrets returns the secrets of the server's clients, by name.
+func clientSecrets() map[string]corev1.Secret {
+	list, err := k.Client().CoreV1().Secrets(namespace).List(metav1.ListOptions{
+		LabelSelector: ownerSelector(),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clients := map[string]corev1.Secret{}
+	for _, sec := range list.Items {
+		if name, ok := sec.Labels[clientLabel]; ok {
+			clients[name] = sec
+		} else if sec.Name == clientSecretName(defaultClient) {
+			clients[defaultClient] = sec
+		}
+	}
+	return clients
+}
+
+func clientsListRun(cmd *Command, args []string) {
+	clients := clientSecrets()
+
+	revoked := map[string]bool{}
+	cm := &corev1.ConfigMap{}
+	if err := objects.Get(revokedConfigMap(), cm); err == nil {
+		revoked = revokedSerials(cm)
+	} else if !errors.IsNotFound(err) {
+		log.Fatal(err)
+	}
+
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+
+	fmt.Fprintln(out, "NAME\tOWNER\tCREATED\tEXPIRES\tSERIAL\tSTATUS")
+	for _, name := range names {
+		sec := clients[name]
+
+		status := "valid"
+		serial, expires := sec.Annotations[serialAnnotation], sec.Annotations[expiresAnnotation]
+		if crt := parseCertificatePEM(sec.Data["tls.crt"]); crt != nil {
+			serial = crt.SerialNumber.Text(16)
+			expires = crt.NotAfter.UTC().Format(time.RFC3339)
+			if time.Now().After(crt.NotAfter) {
+				status = "expired"
+			}
+		}
+		if revoked[serial] {
+			status = "revoked"
+		}
+
+		created := sec.Annotations[createdAnnotation]
+		if created == "" {
+			created = sec.CreationTimestamp.UTC().Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\n", name, valueOr(sec.Annotations[ownerAnnotation], "-"),
+			created, valueOr(expires, "-"), valueOr(serial, "-"), status)
+	}
+}
+
+func valueOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	nameLabel      = "app.kubernetes.io/name"
+	componentLabel = "app.kubernetes.io/component"
+)
+
+var (
+	httpPort             int
+	internalPort         int
+	runAsUser            int64
+	readOnlyRootFS       bool
+	unprivilegedPortFrom int
+	cpuRequest           string
+	memoryRequest        string
+	cpuLimit             string
+	memoryLimit          string
+	nodeSelector         map[string]string
+	tolerations          []string
+)
+
+func registerDeploymentFlags(flags *pflag.FlagSet) {
+	flags.IntVar(&httpPort, "http-port", 8080, "Server's HTTP port in the pod")
+	flags.IntVar(&internalPort, "internal-port", 8081, "Server's internal HTTP port in the pod, for health, status and metrics")
+	flags.Int64Var(&runAsUser, "run-as-user", 65534, "UID of the server, 0 to run as root")
+	flags.BoolVar(&readOnlyRootFS, "read-only-root-fs", true, "Mount the server's root filesystem read-only")
+	flags.IntVar(&unprivilegedPortFrom, "unprivileged-port-start", -1, "Set the net.ipv4.ip_unprivileged_port_start sysctl, so local transfers can use ports below 1024 as non-root (unset if negative)")
+	flags.StringVar(&cpuRequest, "cpu-request", "10m", "Server CPU request, none if empty")
+	flags.StringVar(&memoryRequest, "memory-request", "32Mi", "Server memory request, none if empty")
+	flags.StringVar(&cpuLimit, "cpu-limit", "", "Server CPU limit, none if empty")
+	flags.StringVar(&memoryLimit, "memory-limit", "128Mi", "Server memory limit, none if empty")
+	flags.StringToStringVar(&nodeSelector, "node-selector", nil, "Node selector for the server (key=value, repeatable)")
+	flags.StringArrayVar(&tolerations, "toleration", nil, "Toleration for the server, as key[=value][:effect] (repeatable)")
+}
+
+// serverLabels are the standard labels of the server's objects.
+func serverLabels() map[string]string {
+	labels := ownerLabels()
+	labels[nameLabel] = "kgate"
+	labels[componentLabel] = "server"
+	return labels
+}
+
+func buildDeployment() *apps.Deployment {
+	args := []string{
+		"server",
+		fmt.Sprintf("--http=:%d", httpPort),
+		fmt.Sprintf("--internal=:%d", internalPort),
+		"--ca=/secrets/ca/ca.crt",
+		"--crt=/secrets/server/tls.crt",
+		"--key=/secrets/server/tls.key",
+	}
+	if rawTLS() {
+		args = append(args, fmt.Sprintf("--tls=:%d", tlsPort))
+	}
+
+	podLabels := serverLabels()
+	podLabels["app"] = serverName
+
+	healthz := &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/healthz",
+				Port: intstr.FromString("internal"),
+			},
+		},
+		PeriodSeconds: 10,
+	}
+
+	ports := []corev1.ContainerPort{
+		{
+			Name:          "http",
+			ContainerPort: int32(httpPort),
+		},
+		{
+			Name:          "internal",
+			ContainerPort: int32(internalPort),
+		},
+	}
+	if rawTLS() {
+		ports = append(ports, corev1.ContainerPort{
+			Name:          "tls",
+			ContainerPort: tlsPort,
+		})
+	}
+
+	// a single replica: clients hold their session on one pod, and another
+	// would accept connections it has no client to tunnel them to
+	replicas := int32(1)
+
+	dep := &apps.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serverName,
+			Namespace: namespace,
+			Labels:    serverLabels(),
+		},
+		Spec: apps.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: selector(),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: podLabels,
+				},
+				Spec: corev1.PodSpec{
+					AutomountServiceAccountToken: boolPtr(false),
+					SecurityContext:              podSecurityContext(),
+					NodeSelector:                 nodeSelector,
+					Tolerations:                  parseTolerations(),
+					Containers: []corev1.Container{
+						{
+							Name:  serverName,
+							Image: deployImage,
+							Env: []corev1.EnvVar{
+								{
+									Name:  "CONFIG",
+									Value: "{}",
+								},
+							},
+							Args:            args,
+							Ports:           ports,
+							Resources:       resourceRequirements(),
+							SecurityContext: containerSecurityContext(),
+							LivenessProbe:   healthz,
+							ReadinessProbe:  healthz,
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "ca",
+									MountPath: "/secrets/ca",
+									ReadOnly:  true,
+								},
+								{
+									Name:      "server",
+									MountPath: "/secrets/server",
+									ReadOnly:  true,
+								},
+								{
+									// writable, for unix socket transfers
+									Name:      "tmp",
+									MountPath: "/tmp",
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "ca",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: secretCA,
+									Items: []corev1.KeyToPath{
+										{
+											Key:  "tls.crt",
+											Path: "ca.crt",
+										},
+									},
+								},
+							},
+						},
+						{
+							Name: "server",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: secretServer,
+								},
+							},
+						},
+						{
+							Name: "tmp",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	addRevocationMount(&dep.Spec.Template.Spec)
+	addClientTransfersMount(&dep.Spec.Template.Spec)
+
+	return dep
+}
+
+func podSecurityContext() *corev1.PodSecurityContext {
+	sc := &corev1.PodSecurityContext{}
+
+	if runAsUser != 0 {
+		sc.RunAsUser = &runAsUser
+		sc.RunAsGroup = &runAsUser
+		sc.RunAsNonRoot = boolPtr(true)
+	}
+
+	if unprivilegedPortFrom >= 0 {
+		sc.Sysctls = []corev1.Sysctl{
+			{
+				Name:  "net.ipv4.ip_unprivileged_port_start",
+				Value: strconv.Itoa(unprivilegedPortFrom),
+			},
+		}
+	}
+
+	return sc
+}
+
+func containerSecurityContext() *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: boolPtr(false),
+		ReadOnlyRootFilesystem:   boolPtr(readOnlyRootFS),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
+
+func resourceRequirements() corev1.ResourceRequirements {
+	req := corev1.ResourceRequirements{}
+
+	for _, r := range []struct {
+		list  *corev1.ResourceList
+		name  corev1.ResourceName
+		value string
+	}{
+		{&req.Requests, corev1.ResourceCPU, cpuRequest},
+		{&req.Requests, corev1.ResourceMemory, memoryRequest},
+		{&req.Limits, corev1.ResourceCPU, cpuLimit},
+		{&req.Limits, corev1.ResourceMemory, memoryLimit},
+	} {
+		if r.value == "" {
+			continue
+		}
+
+		q, err := resource.ParseQuantity(r.value)
+		if err != nil {
+			log.Fatal("Invalid ", r.name, " quantity ", r.value, ": ", err)
+		}
+
+		if *r.list == nil {
+			*r.list = corev1.ResourceList{}
+		}
+		(*r.list)[r.name] = q
+	}
+
+	return req
+}
+
+// parseTolerations parses the tolerations in the kubectl taint syntax,
+// key[=value][:effect]; without a value, the key only has to exist.
+func parseTolerations() (result []corev1.Toleration) {
+	for _, spec := range tolerations {
+		t := corev1.Toleration{}
+
+		if idx := strings.LastIndexByte(spec, ':'); idx >= 0 {
+			t.Effect = corev1.TaintEffect(spec[idx+1:])
+			spec = spec[:idx]
+
+			switch t.Effect {
+			case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+				// ok
+			default:
+				log.Fatal("Invalid toleration effect: ", t.Effect)
+			}
+		}
+
+		if idx := strings.IndexByte(spec, '='); idx >= 0 {
+			t.Key, t.Value = spec[:idx], spec[idx+1:]
+			t.Operator = corev1.TolerationOpEqual
+		} else {
+			t.Key = spec
+			t.Operator = corev1.TolerationOpExists
+		}
+
+		result = append(result, t)
+	}
+	return
+}
+
+// canBindPort tells if the deployed server can listen on the given port.
+func canBindPort(dep *apps.Deployment, port int) bool {
+	if port >= 1024 {
+		return true
+	}
+
+	sc := dep.Spec.Template.Spec.SecurityContext
+	if sc == nil || sc.RunAsUser == nil || *sc.RunAsUser == 0 {
+		return true
+	}
+
+	for _, sysctl := range sc.Sysctls {
+		if sysctl.Name == "net.ipv4.ip_unprivileged_port_start" {
+			start, err := strconv.Atoi(sysctl.Value)
+			return err == nil && port >= start
+		}
+	}
+
+	return false
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
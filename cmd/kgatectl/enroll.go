@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+
+	k "github.com/mcluseau/kubeclient"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/mcluseau/kgate/pki"
+)
+
+const (
+	csrPath = "/apis/certificates.k8s.io/v1/certificatesigningrequests"
+
+	// signerDomain prefixes the Kubernetes signer name of each server.
+	signerDomain = "kgate.mcluseau.github.io"
+)
+
+var csrFile string
+
+func enrollCommand() *Command {
+	cmd := &Command{
+		Use: "enroll",
+	}
+
+	sign := &Command{
+		Use: "sign",
+		Run: enrollSignRun,
+	}
+	submit := &Command{
+		Use: "submit",
+		Run: enrollSubmitRun,
+	}
+	issue := &Command{
+		Use: "issue",
+		Run: enrollIssueRun,
+	}
+
+	for _, c := range []*Command{sign, submit, issue} {
+		flags := c.Flags()
+		flags.StringVar(&serverName, "server-name", "kgate", "The server name")
+		flags.StringVar(&clientOwner, "owner", os.Getenv("USER"), "Owner of the client, recorded in its secret")
+		if c != issue {
+			flags.StringVar(&csrFile, "csr", "", "Certificate signing request of the client, from kgate client enroll")
+		}
+		if c != submit {
+			flags.StringVar(&clientGateway, "gw", "", "Gateway URL for the client, found from the server's exposure if empty")
+			flags.BoolVar(&revokePrevious, "revoke-previous", false, "Revoke the replaced certificate of a client enrolling again")
+			registerValidityFlag(flags)
+			registerIngressAPIFlag(flags)
+		}
+	}
+
+	cmd.AddCommand(sign, submit, issue)
+
+	return cmd
+}
+
+// readCSR reads and checks the CSR file, returning it with its PEM data.
+func readCSR() (*x509.CertificateRequest, []byte) {
+	if csrFile == "" {
+		log.Fatal("A CSR is required (--csr)")
+	}
+
+	csrPEM, err := ioutil.ReadFile(csrFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	csr, err := pki.ParseCSR(csrPEM)
+	if err != nil {
+		log.Fatal(csrFile, ": ", err)
+	}
+
+	validateClientName(csr.Subject.CommonName)
+
+	return csr, csrPEM
+}
+
+// enrollSignRun signs a CSR right away, the admin running it approves it.
+func enrollSignRun(cmd *Command, args []string) {
+	secretCA = serverName + "-ca"
+
+	csr, _ := readCSR()
+
+	secCA := &corev1.Secret{}
+	if err := objects.Get(secretCA, secCA); err != nil {
+		log.Fatal(err)
+	}
+
+	url := clientGateway
+	if url == "" {
+		url = gatewayURL()
+	}
+
+	sec := enrollClient(csr, secCA)
+	writeClientBundle(sec, secCA, url)
+}
+
+// enrollClient issues the client certificate for the CSR's key, and records
+// it in the client's secret, without key.
+func enrollClient(csr *x509.CertificateRequest, secCA *corev1.Secret) *corev1.Secret {
+	name := csr.Subject.CommonName
+	secretName := clientSecretName(name)
+
+	sec := &corev1.Secret{}
+	err := objects.Get(secretName, sec)
+
+	found := true
+	if errors.IsNotFound(err) {
+		found = false
+		sec = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        secretName,
+				Namespace:   namespace,
+				Labels:      ownerLabels(),
+				Annotations: map[string]string{ownerAnnotation: clientOwner},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{},
+		}
+		sec.Labels[clientLabel] = name
+
+	} else if err != nil {
+		log.Fatal(err)
+
+	} else if _, ok := sec.Data["tls.key"]; ok {
+		log.Fatal("Client ", name, " has a key issued by gen-key, it can't enroll")
+	}
+
+	if sec.Annotations == nil {
+		sec.Annotations = map[string]string{}
+	}
+
+	previous := parseCertificatePEM(sec.Data["tls.crt"])
+
+	log.Print("Issuing certificate for enrolled client ", name)
+	setClientCertificate(sec, signCertificate(secCA.Data, csr.PublicKey, name, nil, x509.ExtKeyUsageClientAuth))
+	delete(sec.Annotations, revokedAnnotation)
+
+	if found {
+		err = objects.Update(sec)
+	} else {
+		err = objects.Create(sec)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if previous != nil && revokePrevious {
+		serial := previous.SerialNumber.Text(16)
+		if addRevokedSerial(serial, name) {
+			log.Print("Revoked the previous certificate of client ", name, " (serial ", serial, ")")
+		}
+		ensureRevocationMount()
+	}
+
+	return sec
+}
+
+// signerName is the Kubernetes signer of the server's client certificates.
+func signerName() string {
+	return signerDomain + "/" + namespace + "." + serverName
+}
+
+// enrollSubmitRun creates a Kubernetes CertificateSigningRequest, to be
+// approved with kubectl certificate approve then signed by enroll issue.
+func enrollSubmitRun(cmd *Command, args []string) {
+	csr, csrPEM := readCSR()
+	name := csr.Subject.CommonName
+
+	labels := map[string]interface{}{
+		managedByLabel: managedBy,
+		instanceLabel:  serverName,
+		clientLabel:    name,
+	}
+
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "certificates.k8s.io/v1",
+			"kind":       "CertificateSigningRequest",
+			"metadata": map[string]interface{}{
+				"name":        "kgate-" + namespace + "-" + serverName + "-" + name,
+				"labels":      labels,
+				"annotations": map[string]interface{}{ownerAnnotation: clientOwner},
+			},
+			"spec": map[string]interface{}{
+				"request":    base64.StdEncoding.EncodeToString(csrPEM),
+				"signerName": signerName(),
+				"usages":     []interface{}{"digital signature", "client auth"},
+			},
+		},
+	}
+
+	err := rawRequest(k.Client().Discovery().RESTClient().Post().AbsPath(csrPath), obj)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("Submitted ", obj.GetName(), ", approve it with: kubectl certificate approve ", obj.GetName())
+	log.Print("then sign it with: kgatectl -n ", namespace, " enroll issue")
+}
+
+// enrollIssueRun signs the approved CertificateSigningRequests of the server.
+func enrollIssueRun(cmd *Command, args []string) {
+	secretCA = serverName + "-ca"
+
+	rest := k.Client().Discovery().RESTClient()
+
+	ba, err := rest.Get().AbsPath(csrPath).Param("labelSelector", ownerSelector()).DoRaw()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	list := &unstructured.UnstructuredList{}
+	if err := list.UnmarshalJSON(ba); err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		secCA *corev1.Secret
+		url   string
+	)
+
+	for i := range list.Items {
+		obj := &list.Items[i]
+		name := obj.GetName()
+
+		if signer, _, _ := unstructured.NestedString(obj.Object, "spec", "signerName"); signer != signerName() {
+			continue
+		}
+		if crt, _, _ := unstructured.NestedString(obj.Object, "status", "certificate"); crt != "" {
+			continue
+		}
+
+		switch csrApproval(obj) {
+		case "Denied":
+			continue
+		case "":
+			log.Print(name, " is waiting for approval (kubectl certificate approve ", name, ")")
+			continue
+		}
+
+		request, _, _ := unstructured.NestedString(obj.Object, "spec", "request")
+		csrPEM, err := base64.StdEncoding.DecodeString(request)
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+
+		csr, err := pki.ParseCSR(csrPEM)
+		if err != nil {
+			log.Print(name, ": ", err, ", skipped")
+			continue
+		}
+		if !clientNameRegexp.MatchString(csr.Subject.CommonName) {
+			log.Print(name, ": invalid client name ", csr.Subject.CommonName, ", skipped")
+			continue
+		}
+
+		if secCA == nil {
+			secCA = &corev1.Secret{}
+			if err := objects.Get(secretCA, secCA); err != nil {
+				log.Fatal(err)
+			}
+
+			url = clientGateway
+			if url == "" {
+				url = gatewayURL()
+			}
+		}
+
+		if owner, ok := obj.GetAnnotations()[ownerAnnotation]; ok {
+			clientOwner = owner
+		}
+
+		sec := enrollClient(csr, secCA)
+
+		unstructured.SetNestedField(obj.Object, base64.StdEncoding.EncodeToString(sec.Data["tls.crt"]), "status", "certificate")
+		if err := rawRequest(rest.Put().AbsPath(csrPath, name, "status"), obj); err != nil {
+			log.Fatal(err)
+		}
+
+		writeClientBundle(sec, secCA, url)
+	}
+}
+
+// csrApproval returns Approved or Denied, or empty if neither yet.
+func csrApproval(obj *unstructured.Unstructured) string {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		if condition["status"] != "True" {
+			continue
+		}
+		if t := condition["type"]; t == "Approved" || t == "Denied" {
+			return t.(string)
+		}
+	}
+	return ""
+}
@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 
-	k "github.com/mcluseau/kubeclient"
+	apps "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	ext "k8s.io/api/extensions/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -17,9 +17,13 @@ import (
 
 var (
 	serviceName  string
-	servicePort  int
-	localPort    int
+	servicePort  string
+	localPort    string
 	remoteTarget string
+	strategy     string
+
+	proxyProtocol       int
+	acceptProxyProtocol bool
 )
 
 func exposeRemoteCommand() *Command {
@@ -29,20 +33,37 @@ func exposeRemoteCommand() *Command {
 	}
 
 	flags := cmd.Flags()
-	flags.IntVar(&localPort, "local-port", 0, "Local server port to forward")
+	flags.StringVar(&serverName, "server-name", "kgate", "The server name")
+	flags.StringVar(&localPort, "local-port", "", "Local server port (or port range, ie 5000-5049) to forward")
 	flags.StringVar(&serviceName, "service", "", "Local service name")
-	flags.IntVar(&servicePort, "service-port", 0, "Local service port")
-	flags.StringVar(&remoteTarget, "remote-target", "", "Remote target to forward to")
+	flags.StringVar(&servicePort, "service-port", "", "Local service port (or port range)")
+	flags.StringVar(&remoteTarget, "remote-target", "", "Remote target to forward to (comma separated for multiple targets, with a port range matching the local one if any)")
+	flags.StringVar(&strategy, "strategy", "", "Strategy for multiple targets (first-available, round-robin, least-connections, source-hash)")
+	flags.IntVar(&proxyProtocol, "proxy-protocol", 0, "PROXY protocol version (1 or 2) to send to the remote target")
+	flags.BoolVar(&acceptProxyProtocol, "accept-proxy-protocol", false, "Expect a PROXY protocol header from an upstream load balancer")
+	registerNetworkPolicyFlags(flags)
+	registerOutputFlags(flags)
 
 	return cmd
 }
 
 func exposeRemoteRun(cmd *Command, args []string) {
+	setupOutput()
+	validateNetworkPolicyFlags()
+
+	if rendering() && outputDir == "" {
+		log.Fatal("Rendering requires --output-dir with the server's rendered deployment")
+	}
+
 	if serviceName == "" {
 		log.Fatal("Service name is required")
 	}
 
-	if localPort == 0 {
+	if serviceName == serverName || serviceName == gatewayService() {
+		log.Fatal("Service ", serviceName, " is reserved for the server")
+	}
+
+	if localPort == "" {
 		log.Fatal("Local port is required")
 	}
 
@@ -50,53 +71,124 @@ func exposeRemoteRun(cmd *Command, args []string) {
 		log.Fatal("Remote target is required")
 	}
 
-	if servicePort == 0 {
+	if !config.ValidStrategy(strategy) {
+		log.Fatal("Invalid strategy: ", strategy)
+	}
+
+	if proxyProtocol < 0 || proxyProtocol > 2 {
+		log.Fatal("Invalid PROXY protocol version: ", proxyProtocol)
+	}
+
+	if servicePort == "" {
 		servicePort = localPort
 	}
 
+	localFirst, localLast, err := config.ParsePortRange(localPort)
+	if err != nil {
+		log.Fatal("Invalid local port: ", err)
+	}
+
+	serviceFirst, serviceLast, err := config.ParsePortRange(servicePort)
+	if err != nil {
+		log.Fatal("Invalid service port: ", err)
+	}
+
+	if serviceLast-serviceFirst != localLast-localFirst {
+		log.Fatal("Service port range doesn't match the local port range")
+	}
+
+	targets := strings.Split(remoteTarget, ",")
+	if err := config.ValidateRanges(":"+localPort, targets); err != nil {
+		log.Fatal("Invalid remote target: ", err)
+	}
+
+	tr := &config.TransferTarget{
+		Target:   targets[0],
+		Targets:  targets[1:],
+		Strategy: strategy,
+
+		ProxyProtocol:       proxyProtocol,
+		AcceptProxyProtocol: acceptProxyProtocol,
+	}
+
 	dep, cfg := fetchConfig()
-	if cfg.LocalTransfers == nil {
-		cfg.LocalTransfers = map[int]*config.TransferTarget{}
+	if !canBindPort(dep, localFirst) {
+		log.Fatal("The server runs as non-root and can't listen on port ", localFirst,
+			", use a local port above 1023 (with --service-port for the service) or init with --unprivileged-port-start")
+	}
+	if localFirst == localLast {
+		if cfg.LocalTransfers == nil {
+			cfg.LocalTransfers = map[int]*config.TransferTarget{}
+		}
+		cfg.LocalTransfers[localFirst] = tr
+
+	} else {
+		if cfg.Transfers == nil {
+			cfg.Transfers = map[string]*config.TransferTarget{}
+		}
+		cfg.Transfers[fmt.Sprintf(":%d-%d", localFirst, localLast)] = tr
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal("Local port already exposed: ", err)
 	}
-	cfg.LocalTransfers[localPort] = &config.TransferTarget{remoteTarget}
 	setConfig(dep, cfg)
+	applyNetworkPolicy(dep)
 
 	// update the service
-	svc := getOrCreateService()
+	ports := portSpecs(localFirst, localLast, serviceFirst)
+	svc, found := fetchService()
+
+	for _, spec := range ports {
+		portFound := false
+		for idx := range svc.Spec.Ports {
+			if svc.Spec.Ports[idx].Port == spec.Port {
+				svc.Spec.Ports[idx].TargetPort = spec.TargetPort
+				portFound = true
+				break
+			}
+		}
 
-	portFound := false
-	for _, port := range svc.Spec.Ports {
-		if port.Port == int32(servicePort) {
-			port.TargetPort = intstr.FromInt(localPort)
-			portFound = true
-			break
+		if !portFound {
+			svc.Spec.Ports = append(svc.Spec.Ports, spec)
 		}
 	}
 
-	if !portFound {
-		svc.Spec.Ports = append(svc.Spec.Ports, portSpec())
+	if found {
+		err = objects.Update(svc)
+	} else {
+		log.Print("Creating service ", serviceName)
+		err = objects.Create(svc)
 	}
 
-	services := k.Client().CoreV1().Services(namespace)
-	if _, err := services.Update(svc); err != nil {
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func portSpec() corev1.ServicePort {
-	return corev1.ServicePort{
-		Name:       fmt.Sprintf("p%d", servicePort),
-		Port:       int32(servicePort),
-		TargetPort: intstr.FromInt(localPort),
-	}
+func portSpecs(localFirst, localLast, serviceFirst int) []corev1.ServicePort {
+	ports := make([]corev1.ServicePort, 0, localLast-localFirst+1)
+	for offset := 0; offset <= localLast-localFirst; offset++ {
+		port := serviceFirst + offset
+		ports = append(ports, corev1.ServicePort{
+			Name:       fmt.Sprintf("p%d", port),
+			Port:       int32(port),
+			TargetPort: intstr.FromInt(localFirst + offset),
+		})
+	}
+	return ports
 }
 
-func fetchConfig() (*ext.Deployment, *config.Config) {
-	dep, err := k.Client().ExtensionsV1beta1().Deployments(namespace).Get(serverName, getOpts)
-	if err != nil {
+func fetchConfig() (*apps.Deployment, *config.Config) {
+	dep := &apps.Deployment{}
+	if err := objects.Get(serverName, dep); err != nil {
 		log.Fatal(err)
 	}
 
+	return dep, deploymentConfig(dep)
+}
+
+// deploymentConfig parses the server's config from its deployment.
+func deploymentConfig(dep *apps.Deployment) *config.Config {
 	cfg := &config.Config{}
 	for _, env := range dep.Spec.Template.Spec.Containers[0].Env {
 		if env.Name == "CONFIG" {
@@ -106,10 +198,10 @@ func fetchConfig() (*ext.Deployment, *config.Config) {
 		}
 	}
 
-	return dep, cfg
+	return cfg
 }
 
-func setConfig(dep *ext.Deployment, cfg *config.Config) {
+func setConfig(dep *apps.Deployment, cfg *config.Config) {
 	ba, err := json.Marshal(cfg)
 	if err != nil {
 		panic(err)
@@ -123,38 +215,32 @@ func setConfig(dep *ext.Deployment, cfg *config.Config) {
 		}
 	}
 
-	if _, err := k.Client().ExtensionsV1beta1().Deployments(namespace).Update(dep); err != nil {
+	if err := objects.Update(dep); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func getOrCreateService() *corev1.Service {
-	services := k.Client().CoreV1().Services(namespace)
-	svc, err := services.Get(serviceName, getOpts)
+// fetchService returns the exposed service, or a new one to create if not found.
+func fetchService() (svc *corev1.Service, found bool) {
+	svc = &corev1.Service{}
+	err := objects.Get(serviceName, svc)
 	if errors.IsNotFound(err) {
-		svc = &corev1.Service{
+		return &corev1.Service{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      serviceName,
 				Namespace: namespace,
+				Labels:    ownerLabels(),
 			},
 			Spec: corev1.ServiceSpec{
 				Selector: map[string]string{
 					"app": serverName,
 				},
-				Ports: []corev1.ServicePort{portSpec()},
 			},
-		}
-
-		svc, err := services.Create(svc)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		return svc
+		}, false
 
 	} else if err != nil {
 		log.Fatal(err)
 	}
 
-	return svc
+	return svc, true
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+
+	k "github.com/mcluseau/kubeclient"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Exposure modes.
+const (
+	ExposeIngress      = "ingress"
+	ExposeLoadBalancer = "loadbalancer"
+	ExposeNodePort     = "nodeport"
+	ExposeNone         = "none"
+)
+
+const (
+	tlsPort     = 8443
+	gatewayPort = 443
+
+	// internalServicePort serves the server's status and metrics, not routed
+	// by the ingress.
+	internalServicePort = 8081
+)
+
+var (
+	exposeMode string
+	nodePort   int
+)
+
+func registerExposureFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&exposeMode, "expose", ExposeIngress, "How clients reach the server (ingress, loadbalancer, nodeport, none)")
+	flags.IntVar(&nodePort, "node-port", 0, "Node port for the nodeport exposure, allocated by the cluster if 0")
+}
+
+func validateExposure() {
+	switch exposeMode {
+	case ExposeIngress, ExposeLoadBalancer, ExposeNodePort, ExposeNone:
+		// ok
+	default:
+		log.Fatal("Invalid exposure mode: ", exposeMode)
+	}
+
+	if nodePort != 0 && exposeMode != ExposeNodePort {
+		log.Fatal("--node-port requires --expose=nodeport")
+	}
+
+	if exposeMode == ExposeIngress {
+		validateIngressHost()
+	}
+}
+
+// rawTLS tells if the server must listen for raw TLS clients.
+func rawTLS() bool {
+	return exposeMode == ExposeLoadBalancer || exposeMode == ExposeNodePort
+}
+
+// gatewayService is the service exposing the raw TLS listener, kept apart
+// from the server's service so the HTTP port stays internal.
+func gatewayService() string {
+	return serverName + "-gateway"
+}
+
+func exposeServer() {
+	switch exposeMode {
+	case ExposeIngress:
+		createIngress()
+
+	case ExposeLoadBalancer, ExposeNodePort:
+		createGatewayService()
+
+	case ExposeNone:
+		log.Print(serverName, " not exposed outside the cluster")
+	}
+}
+
+func createGatewayService() {
+	name := gatewayService()
+
+	if err := objects.Get(name, &corev1.Service{}); errors.IsNotFound(err) {
+		log.Print("Exposing ", serverName, " through a ", exposeMode, " service")
+
+		svcType := corev1.ServiceTypeLoadBalancer
+		if exposeMode == ExposeNodePort {
+			svcType = corev1.ServiceTypeNodePort
+		}
+
+		srv := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    ownerLabels(),
+			},
+			Spec: corev1.ServiceSpec{
+				Type: svcType,
+				Selector: map[string]string{
+					"app": serverName,
+				},
+				Ports: []corev1.ServicePort{
+					{
+						Name:       "tls",
+						Port:       gatewayPort,
+						TargetPort: intstr.FromInt(tlsPort),
+						NodePort:   int32(nodePort),
+					},
+				},
+			},
+		}
+
+		if err := objects.Create(srv); err != nil {
+			log.Fatal(err)
+		}
+
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// gatewayURL finds how clients reach the server: through the gateway service
+// if any, else through the ingress.
+func gatewayURL() string {
+	svc := &corev1.Service{}
+	err := objects.Get(gatewayService(), svc)
+	if errors.IsNotFound(err) {
+		if err := objects.Get(serverName, newIngress()); errors.IsNotFound(err) {
+			log.Fatal(serverName, " is not exposed, the gateway URL must be given with --gw")
+		}
+		return ingressURL()
+
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	switch svc.Spec.Type {
+	case corev1.ServiceTypeLoadBalancer:
+		for _, lb := range svc.Status.LoadBalancer.Ingress {
+			host := lb.Hostname
+			if host == "" {
+				host = lb.IP
+			}
+			if host != "" {
+				return "tls://" + net.JoinHostPort(host, strconv.Itoa(gatewayPort))
+			}
+		}
+		log.Fatal("The load balancer of ", svc.Name, " has no address yet, retry later or use --gw")
+
+	case corev1.ServiceTypeNodePort:
+		if len(svc.Spec.Ports) == 0 || svc.Spec.Ports[0].NodePort == 0 {
+			log.Fatal("No node port allocated on ", svc.Name, " yet, retry later or use --gw")
+		}
+		port := int(svc.Spec.Ports[0].NodePort)
+		return "tls://" + net.JoinHostPort(nodeAddress(), strconv.Itoa(port))
+	}
+
+	log.Fatal("Unsupported type ", svc.Spec.Type, " for service ", svc.Name)
+	return ""
+}
+
+// nodeAddress returns an address of the first node, external if possible.
+func nodeAddress() string {
+	if rendering() {
+		log.Fatal("The node address is unknown when rendering, use --gw")
+	}
+
+	nodes, err := k.Client().CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, addrType := range []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeExternalDNS, corev1.NodeInternalIP} {
+		for _, node := range nodes.Items {
+			for _, addr := range node.Status.Addresses {
+				if addr.Type == addrType {
+					return addr.Address
+				}
+			}
+		}
+	}
+
+	log.Fatal("No node address found, use --gw")
+	return ""
+}
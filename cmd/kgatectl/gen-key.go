@@ -5,7 +5,19 @@ import (
 	"log"
 	"os"
 
-	k "github.com/mcluseau/kubeclient"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/mcluseau/kgate/passphrase"
+	"github.com/mcluseau/kgate/pki"
+)
+
+var (
+	clientGateway string
+
+	encryptBundle    bool
+	passphraseSource passphrase.Source
 )
 
 func genKeyCommand() *Command {
@@ -16,25 +28,70 @@ func genKeyCommand() *Command {
 
 	flags := cmd.Flags()
 	flags.StringVar(&serverName, "server-name", "kgate", "The server name, for the certificate")
+	flags.StringVar(&clientName, "client", defaultClient, "The client name, for its certificate")
+	flags.StringVar(&clientOwner, "owner", os.Getenv("USER"), "Owner of the client, recorded in its secret")
+	flags.StringVar(&clientGateway, "gw", "", "Gateway URL for the client, found from the server's exposure if empty")
+	registerPKIFlags(flags)
+	registerBundleFlags(flags)
+	registerIngressAPIFlag(flags)
+	registerOutputFlags(flags)
 
 	return cmd
 }
 
 func genKeyRun(cmd *Command, args []string) {
+	setupOutput()
+
 	secretCA = serverName + "-ca"
+	validateClientName(clientName)
+
+	if certManager {
+		// the key never leaves the cluster, so no bundle can be written here
+		crt := certManagerCertificate(clientSecretName(clientName), clientName, nil, "client auth")
+		labels := map[string]interface{}{
+			managedByLabel: managedBy,
+			instanceLabel:  serverName,
+			clientLabel:    clientName,
+		}
+		annotations := map[string]interface{}{ownerAnnotation: clientOwner}
+
+		// label the issued secret too, for clients list
+		unstructured.SetNestedMap(crt.Object, labels, "metadata", "labels")
+		unstructured.SetNestedMap(crt.Object, annotations, "metadata", "annotations")
+		unstructured.SetNestedMap(crt.Object, map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		}, "spec", "secretTemplate")
+		if err := objects.Create(crt); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	secCA, err := k.Client().CoreV1().Secrets(namespace).Get(secretCA, getOpts)
-	if err != nil {
+	secCA := &corev1.Secret{}
+	if err := objects.Get(secretCA, secCA); err != nil {
 		log.Fatal(err)
 	}
 
-	sec := getOrCreateTLS(serverName+"-client", func() ([]byte, []byte) {
-		key, keyPEM := PrivateKeyPEM()
-		crtPEM := HostCertificatePEM(secCA.Data, 1, key, "client")
-		return keyPEM, crtPEM
-	})
+	url := clientGateway
+	if url == "" {
+		url = gatewayURL()
+	}
+
+	sec := getOrCreateClient(clientName, secCA.Data)
+
+	writeClientBundle(sec, secCA, url)
+}
+
+func registerBundleFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&encryptBundle, "encrypt", false, "Encrypt the client key in the configuration with a passphrase (prompted, or from the "+passphrase.EnvVar+" env)")
+	flags.StringVar(&passphraseSource.File, "passphrase-file", "", "File containing the passphrase for --encrypt")
+}
 
-	zipFile := serverName + "-client-config.zip"
+// writeClientBundle writes the client's configuration zip. Enrolled clients
+// have no key here, they use theirs.
+func writeClientBundle(sec, secCA *corev1.Secret, url string) {
+	zipFile := sec.Name + "-config.zip"
 
 	out, err := os.Create(zipFile)
 	if err != nil {
@@ -47,13 +104,24 @@ func genKeyRun(cmd *Command, args []string) {
 
 	zw := zip.NewWriter(out)
 
-	for name, data := range map[string][]byte{
-		"url":         []byte("ws://" + serverName + "." + namespace + ".dev.isi.nc:80"),
+	files := map[string][]byte{
+		"url":         []byte(url),
 		"server-name": []byte(serverName),
 		"ca.crt":      secCA.Data["tls.crt"],
 		"client.crt":  sec.Data["tls.crt"],
-		"client.key":  sec.Data["tls.key"],
-	} {
+	}
+	if transfers := clientTransfersManifest(); transfers != nil {
+		files["transfers.json"] = transfers
+	}
+	if key, ok := sec.Data["tls.key"]; ok {
+		if encryptBundle {
+			files["client.key.enc"] = encryptClientKey(sec, key)
+		} else {
+			files["client.key"] = key
+		}
+	}
+
+	for name, data := range files {
 		f, err := zw.Create(name)
 		if err != nil {
 			log.Fatal(err)
@@ -68,3 +136,23 @@ func genKeyRun(cmd *Command, args []string) {
 		log.Fatal(err)
 	}
 }
+
+// encryptClientKey encrypts the key with the passphrase of
+// <server name>/<client name>, as asked by the client.
+func encryptClientKey(sec *corev1.Secret, key []byte) []byte {
+	name := sec.Labels[clientLabel]
+	if name == "" {
+		name = defaultClient
+	}
+
+	pass, err := passphraseSource.Read(serverName+"/"+name, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc, err := pki.EncryptKey(key, pass)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return enc
+}
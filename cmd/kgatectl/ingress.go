@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/discovery"
+)
+
+// Ingress API versions, most recent first.
+var ingressAPIVersions = []string{
+	"networking.k8s.io/v1",
+	"networking.k8s.io/v1beta1",
+	"extensions/v1beta1",
+}
+
+var (
+	ingressHost        string
+	ingressClass       string
+	ingressTLSSecret   string
+	ingressIssuer      string
+	ingressAnnotations map[string]string
+	ingressAPIVersion  string
+)
+
+func registerIngressFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&ingressHost, "host", "", "Ingress host, as a template with .Name and .Namespace (ie {{.Name}}.{{.Namespace}}.example.com), required to create the ingress")
+	flags.StringVar(&ingressClass, "ingress-class", "", "Ingress class")
+	flags.StringVar(&ingressTLSSecret, "tls-secret", "", "Secret holding the ingress TLS certificate (enables wss://)")
+	flags.StringVar(&ingressIssuer, "tls-cluster-issuer", "", "cert-manager cluster issuer for the ingress TLS certificate (enables wss://)")
+	flags.StringToStringVar(&ingressAnnotations, "ingress-annotation", nil, "Extra ingress annotations (key=value, repeatable)")
+	registerIngressAPIFlag(flags)
+}
+
+func registerIngressAPIFlag(flags *pflag.FlagSet) {
+	flags.StringVar(&ingressAPIVersion, "ingress-api", "", "Ingress API version ("+strings.Join(ingressAPIVersions, ", ")+"), discovered if empty")
+}
+
+// ingressGroupVersion returns the ingress API version to use, discovering the
+// most recent one served by the cluster if not forced.
+func ingressGroupVersion() string {
+	if ingressAPIVersion != "" {
+		return ingressAPIVersion
+	}
+
+	if rendering() {
+		ingressAPIVersion = ingressAPIVersions[0]
+		return ingressAPIVersion
+	}
+
+	client, _ := objects.(*clusterStore).clients()
+
+	gv, err := detectIngressAPI(client.Discovery())
+	if err != nil {
+		log.Fatal("failed to discover the ingress API: ", err)
+	}
+
+	ingressAPIVersion = gv
+	return gv
+}
+
+// detectIngressAPI returns the most recent ingress API version served.
+func detectIngressAPI(d discovery.DiscoveryInterface) (string, error) {
+	groups, err := d.ServerGroups()
+	if err != nil {
+		return "", err
+	}
+
+	served := map[string]bool{}
+	for _, group := range groups.Groups {
+		for _, v := range group.Versions {
+			served[v.GroupVersion] = true
+		}
+	}
+
+	for _, gv := range ingressAPIVersions {
+		if !served[gv] {
+			continue
+		}
+
+		resources, err := d.ServerResourcesForGroupVersion(gv)
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		for _, res := range resources.APIResources {
+			if res.Name == "ingresses" {
+				return gv, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("none of %s served", strings.Join(ingressAPIVersions, ", "))
+}
+
+// newIngress returns an empty ingress object of the API version in use.
+func newIngress() *unstructured.Unstructured {
+	ing := &unstructured.Unstructured{}
+	ing.SetAPIVersion(ingressGroupVersion())
+	ing.SetKind("Ingress")
+	return ing
+}
+
+// buildIngress returns the server's ingress in the given API version.
+func buildIngress(apiVersion, host string) *unstructured.Unstructured {
+	annotations := map[string]interface{}{}
+	for k, v := range ingressAnnotations {
+		annotations[k] = v
+	}
+
+	labels := map[string]interface{}{}
+	for k, v := range ownerLabels() {
+		labels[k] = v
+	}
+
+	path := map[string]interface{}{}
+	if apiVersion == "networking.k8s.io/v1" {
+		path["path"] = "/"
+		path["pathType"] = "Prefix"
+		path["backend"] = map[string]interface{}{
+			"service": map[string]interface{}{
+				"name": serverName,
+				"port": map[string]interface{}{"number": int64(80)},
+			},
+		}
+	} else {
+		path["backend"] = map[string]interface{}{
+			"serviceName": serverName,
+			"servicePort": int64(80),
+		}
+	}
+
+	spec := map[string]interface{}{
+		"rules": []interface{}{
+			map[string]interface{}{
+				"host": host,
+				"http": map[string]interface{}{
+					"paths": []interface{}{path},
+				},
+			},
+		},
+	}
+
+	if ingressClass != "" {
+		if apiVersion == "networking.k8s.io/v1" {
+			spec["ingressClassName"] = ingressClass
+		} else {
+			annotations["kubernetes.io/ingress.class"] = ingressClass
+		}
+	}
+
+	if ingressTLSSecret != "" || ingressIssuer != "" {
+		secretName := ingressTLSSecret
+		if secretName == "" {
+			secretName = serverName + "-tls"
+		}
+
+		spec["tls"] = []interface{}{
+			map[string]interface{}{
+				"hosts":      []interface{}{host},
+				"secretName": secretName,
+			},
+		}
+	}
+	if ingressIssuer != "" {
+		annotations["cert-manager.io/cluster-issuer"] = ingressIssuer
+	}
+
+	metadata := map[string]interface{}{
+		"name":      serverName,
+		"namespace": namespace,
+		"labels":    labels,
+	}
+	if len(annotations) != 0 {
+		metadata["annotations"] = annotations
+	}
+
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       "Ingress",
+			"metadata":   metadata,
+			"spec":       spec,
+		},
+	}
+}
+
+// ingressHosts returns the hosts of the ingress rules, and the ones with TLS.
+func ingressHosts(ing *unstructured.Unstructured) (hosts, tlsHosts []string) {
+	rules, _, _ := unstructured.NestedSlice(ing.Object, "spec", "rules")
+	for _, rule := range rules {
+		if r, ok := rule.(map[string]interface{}); ok {
+			if host, ok := r["host"].(string); ok {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	tlsList, _, _ := unstructured.NestedSlice(ing.Object, "spec", "tls")
+	for _, tls := range tlsList {
+		if t, ok := tls.(map[string]interface{}); ok {
+			h, _, _ := unstructured.NestedStringSlice(t, "hosts")
+			tlsHosts = append(tlsHosts, h...)
+		}
+	}
+
+	return
+}
+
+// externalHost renders the ingress host template.
+func externalHost() string {
+	tmpl, err := template.New("host").Option("missingkey=error").Parse(ingressHost)
+	if err != nil {
+		log.Fatal("Invalid host template: ", err)
+	}
+
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, map[string]string{
+		"Name":      serverName,
+		"Namespace": namespace,
+	})
+	if err != nil {
+		log.Fatal("Invalid host template: ", err)
+	}
+
+	return buf.String()
+}
+
+// validateIngressHost checks that the host is given when the ingress must be
+// created.
+func validateIngressHost() {
+	if ingressHost != "" {
+		return
+	}
+
+	if err := objects.Get(serverName, newIngress()); errors.IsNotFound(err) {
+		log.Fatal("--host is required to create the ingress (ie --host '{{.Name}}.{{.Namespace}}.example.com')")
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func createIngress() {
+	ing := newIngress()
+
+	if err := objects.Get(serverName, ing); errors.IsNotFound(err) {
+		externalName := externalHost()
+		log.Print("Exposing ", serverName, " to host ", externalName, " (", ingressGroupVersion(), ")")
+
+		if err := objects.Create(buildIngress(ingressGroupVersion(), externalName)); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print(serverName, " exposed to host ", externalName)
+		return
+
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	hosts, _ := ingressHosts(ing)
+	log.Print(serverName, " exposed to host ", strings.Join(hosts, ", "))
+}
+
+// ingressURL is the gateway URL of the server's ingress, wss:// when it has
+// TLS for the host.
+func ingressURL() string {
+	ing := newIngress()
+	if err := objects.Get(serverName, ing); err != nil {
+		log.Fatal("failed to fetch the server's ingress: ", err)
+	}
+
+	hosts, tlsHosts := ingressHosts(ing)
+	if len(hosts) == 0 || hosts[0] == "" {
+		log.Fatal("the server's ingress has no host")
+	}
+
+	host := hosts[0]
+
+	for _, h := range tlsHosts {
+		if strings.EqualFold(h, host) {
+			return "wss://" + host + ":443"
+		}
+	}
+
+	return "ws://" + host + ":80"
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func fakeDiscovery(served map[string][]string) *fakediscovery.FakeDiscovery {
+	fake := &k8stesting.Fake{}
+	for gv, names := range served {
+		list := &metav1.APIResourceList{GroupVersion: gv}
+		for _, name := range names {
+			list.APIResources = append(list.APIResources, metav1.APIResource{Name: name, Namespaced: true})
+		}
+		fake.Resources = append(fake.Resources, list)
+	}
+	return &fakediscovery.FakeDiscovery{Fake: fake}
+}
+
+func TestDetectIngressAPI(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		served map[string][]string
+		want   string
+	}{
+		{
+			name: "networking v1",
+			served: map[string][]string{
+				"networking.k8s.io/v1": {"ingresses", "networkpolicies"},
+				"extensions/v1beta1":   {"ingresses"},
+			},
+			want: "networking.k8s.io/v1",
+		},
+		{
+			name: "extensions only",
+			served: map[string][]string{
+				"networking.k8s.io/v1": {"networkpolicies"},
+				"extensions/v1beta1":   {"ingresses", "deployments"},
+			},
+			want: "extensions/v1beta1",
+		},
+	} {
+		got, err := detectIngressAPI(fakeDiscovery(tc.served))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDetectIngressAPINone(t *testing.T) {
+	_, err := detectIngressAPI(fakeDiscovery(map[string][]string{
+		"v1":                   {"services"},
+		"networking.k8s.io/v1": {"networkpolicies"},
+	}))
+	if err == nil {
+		t.Fatal("expected an error when no ingress API is served")
+	}
+}
+
+func TestIngressAPIOverride(t *testing.T) {
+	defer func(v string) { ingressAPIVersion = v }(ingressAPIVersion)
+
+	// no client configured: detection would fail
+	ingressAPIVersion = "extensions/v1beta1"
+	if got := ingressGroupVersion(); got != "extensions/v1beta1" {
+		t.Errorf("got %s, want the forced extensions/v1beta1", got)
+	}
+}
@@ -5,12 +5,9 @@ import (
 
 	apps "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	ext "k8s.io/api/extensions/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
-
-	k "github.com/mcluseau/kubeclient"
 )
 
 var (
@@ -29,106 +26,43 @@ func initCommand() *Command {
 	flags := cmd.Flags()
 	flags.StringVar(&serverName, "server-name", "kgate", "The server name, for the certificate")
 	flags.StringVar(&deployImage, "image", "mcluseau/kgate", "The server's image")
+	registerPKIFlags(flags)
+	registerCAFlags(flags)
+	registerServerSANFlag(flags)
+	registerDeploymentFlags(flags)
+	registerExposureFlags(flags)
+	registerIngressFlags(flags)
+	registerNetworkPolicyFlags(flags)
+	registerOutputFlags(flags)
 
 	return cmd
 }
 
 func initRun(cmd *Command, args []string) {
+	setupOutput()
+	validateExposure()
+	validateNetworkPolicyFlags()
 
 	secretCA = serverName + "-ca"
 	secretServer = serverName + "-server"
 
-	secCA := getOrCreateTLS(secretCA, func() ([]byte, []byte) {
-		key, keyPEM := PrivateKeyPEM()
-		crtPEM := SelfSignedCertificatePEM("CA", "CA", 5, key)
-		return keyPEM, crtPEM
-	})
+	if certManager {
+		createCertManagerPKI()
 
-	getOrCreateTLS(secretServer, func() ([]byte, []byte) {
-		key, keyPEM := PrivateKeyPEM()
-		crtPEM := HostCertificatePEM(secCA.Data, 1, key, serverName)
-		return keyPEM, crtPEM
-	})
+	} else {
+		secCA := getOrCreateTLS(secretCA, newCA)
 
-	deploys := k.Client().Apps().Deployments(namespace)
-	if _, err := deploys.Get(serverName, getOpts); errors.IsNotFound(err) {
-		log.Print("Creating deployment ", serverName)
+		getOrCreateTLS(secretServer, func() ([]byte, []byte) {
+			return issueServerCertificate(secCA.Data)
+		})
+	}
 
-		var one int32 = 1
+	dep := &apps.Deployment{}
+	if err := objects.Get(serverName, dep); errors.IsNotFound(err) {
+		log.Print("Creating deployment ", serverName)
 
-		dep := &apps.Deployment{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      serverName,
-				Namespace: namespace,
-			},
-			Spec: apps.DeploymentSpec{
-				Replicas: &one,
-				Selector: selector(),
-				Template: corev1.PodTemplateSpec{
-					ObjectMeta: metav1.ObjectMeta{
-						Labels: map[string]string{
-							"app": serverName,
-						},
-					},
-					Spec: corev1.PodSpec{
-						Containers: []corev1.Container{
-							{
-								Name:  serverName,
-								Image: deployImage,
-								Env: []corev1.EnvVar{
-									{
-										Name:  "CONFIG",
-										Value: "{}",
-									},
-								},
-								Args: []string{
-									"server",
-									"--http=:80",
-									"--ca=/secrets/ca/ca.crt",
-									"--crt=/secrets/server/tls.crt",
-									"--key=/secrets/server/tls.key",
-								},
-								VolumeMounts: []corev1.VolumeMount{
-									{
-										Name:      "ca",
-										MountPath: "/secrets/ca",
-									},
-									{
-										Name:      "server",
-										MountPath: "/secrets/server",
-									},
-								},
-							},
-						},
-						Volumes: []corev1.Volume{
-							{
-								Name: "ca",
-								VolumeSource: corev1.VolumeSource{
-									Secret: &corev1.SecretVolumeSource{
-										SecretName: secretCA,
-										Items: []corev1.KeyToPath{
-											{
-												Key:  "tls.crt",
-												Path: "ca.crt",
-											},
-										},
-									},
-								},
-							},
-							{
-								Name: "server",
-								VolumeSource: corev1.VolumeSource{
-									Secret: &corev1.SecretVolumeSource{
-										SecretName: secretServer,
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		}
-		if _, err := deploys.Create(dep); err != nil {
+		dep = buildDeployment()
+		if err := objects.Create(dep); err != nil {
 			log.Fatal(err)
 		}
 
@@ -136,14 +70,14 @@ func initRun(cmd *Command, args []string) {
 		log.Fatal(err)
 	}
 
-	services := k.Client().CoreV1().Services(namespace)
-	if _, err := services.Get(serverName, getOpts); errors.IsNotFound(err) {
+	if err := objects.Get(serverName, &corev1.Service{}); errors.IsNotFound(err) {
 		log.Print("Creating service ", serverName)
 
 		srv := &corev1.Service{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      serverName,
 				Namespace: namespace,
+				Labels:    serverLabels(),
 			},
 			Spec: corev1.ServiceSpec{
 				Selector: map[string]string{
@@ -151,14 +85,20 @@ func initRun(cmd *Command, args []string) {
 				},
 				Ports: []corev1.ServicePort{
 					{
-						Name: "http",
-						Port: 80,
+						Name:       "http",
+						Port:       80,
+						TargetPort: intstr.FromString("http"),
+					},
+					{
+						Name:       "internal",
+						Port:       internalServicePort,
+						TargetPort: intstr.FromString("internal"),
 					},
 				},
 			},
 		}
 
-		if _, err := services.Create(srv); err != nil {
+		if err := objects.Create(srv); err != nil {
 			log.Fatal(err)
 		}
 
@@ -166,47 +106,27 @@ func initRun(cmd *Command, args []string) {
 		log.Fatal(err)
 	}
 
-	externalName := serverName + "." + namespace + ".dev.isi.nc"
-
-	ings := k.Client().ExtensionsV1beta1().Ingresses(namespace)
-	ing, err := ings.Get(serverName, getOpts)
-	if errors.IsNotFound(err) {
-		log.Print("Exposing ", serverName, " to host ", externalName)
-		ing = &ext.Ingress{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      serverName,
-				Namespace: namespace,
-			},
-			Spec: ext.IngressSpec{
-				Rules: []ext.IngressRule{
-					{
-						Host: externalName,
-						IngressRuleValue: ext.IngressRuleValue{
-							HTTP: &ext.HTTPIngressRuleValue{
-								Paths: []ext.HTTPIngressPath{
-									{
-										Backend: ext.IngressBackend{
-											ServiceName: serverName,
-											ServicePort: intstr.FromInt(80),
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		}
+	exposeServer()
+	applyNetworkPolicy(dep)
+}
 
-		if _, err := ings.Create(ing); err != nil {
-			log.Fatal(err)
-		}
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	instanceLabel  = "app.kubernetes.io/instance"
+	managedBy      = "kgatectl"
+)
 
-	} else if err != nil {
-		log.Fatal(err)
+// ownerLabels mark the objects created for the server, so uninstall only
+// touches those.
+func ownerLabels() map[string]string {
+	return map[string]string{
+		managedByLabel: managedBy,
+		instanceLabel:  serverName,
 	}
+}
 
-	log.Print(serverName, " exposed to host ", externalName)
+func ownerSelector() string {
+	return managedByLabel + "=" + managedBy + "," + instanceLabel + "=" + serverName
 }
 
 func selector() *metav1.LabelSelector {
@@ -218,29 +138,16 @@ func selector() *metav1.LabelSelector {
 }
 
 func getOrCreateTLS(name string, createKeyCert func() ([]byte, []byte)) *corev1.Secret {
-	secrets := k.Client().Core().Secrets(namespace)
-	sec, err := secrets.Get(name, getOpts)
+	sec := &corev1.Secret{}
+	err := objects.Get(name, sec)
 
 	if errors.IsNotFound(err) {
 		log.Print("Generating TLS secret ", name)
 
 		key, crt := createKeyCert()
+		sec = newTLSSecret(name, key, crt)
 
-		sec := &corev1.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      name,
-				Namespace: namespace,
-			},
-			Type: corev1.SecretTypeTLS,
-			Data: map[string][]byte{
-				"tls.crt": crt,
-				"tls.key": key,
-			},
-		}
-
-		sec, err := secrets.Create(sec)
-
-		if err != nil {
+		if err := objects.Create(sec); err != nil {
 			log.Fatal("failed to create secret ", name, ": ", err)
 		}
 
@@ -253,3 +160,18 @@ func getOrCreateTLS(name string, createKeyCert func() ([]byte, []byte)) *corev1.
 	log.Print("Secret ", name, " already exists, not regenerating")
 	return sec
 }
+
+func newTLSSecret(name string, key, crt []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    ownerLabels(),
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": crt,
+			"tls.key": key,
+		},
+	}
+}
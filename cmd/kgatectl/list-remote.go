@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	k "github.com/mcluseau/kubeclient"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mcluseau/kgate/config"
+)
+
+func listRemoteCommand() *Command {
+	cmd := &Command{
+		Use: "list-remote",
+		Run: listRemoteRun,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&serverName, "server-name", "kgate", "The server name")
+
+	return cmd
+}
+
+func listRemoteRun(cmd *Command, args []string) {
+	_, cfg := fetchConfig()
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+
+	fmt.Fprintln(out, "SERVICE\tPORT\tLOCAL PORT\tTARGET")
+
+	for _, svc := range remoteServices() {
+		for _, port := range svc.Spec.Ports {
+			localPort := port.TargetPort.IntValue()
+
+			target := "(no transfer)"
+			if tr := transferForPort(cfg, localPort); tr != nil {
+				target = strings.Join(tr.AllTargets(), ",")
+			}
+
+			fmt.Fprintf(out, "%s\t%d\t%d\t%s\n", svc.Name, port.Port, localPort, target)
+		}
+	}
+}
+
+// remoteServices returns the services exposing the server's local transfers.
+func remoteServices() []corev1.Service {
+	list, err := k.Client().CoreV1().Services(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	services := make([]corev1.Service, 0, len(list.Items))
+	for _, svc := range list.Items {
+		if !exposesTransfers(&svc) {
+			continue
+		}
+		services = append(services, svc)
+	}
+
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
+
+// exposesTransfers tells if the service exposes the server's local transfers.
+func exposesTransfers(svc *corev1.Service) bool {
+	return svc.Name != serverName && svc.Name != gatewayService() && svc.Spec.Selector["app"] == serverName
+}
+
+// transferForPort returns the transfer listening on the given port, if any.
+func transferForPort(cfg *config.Config, port int) *config.TransferTarget {
+	if tr, ok := cfg.LocalTransfers[port]; ok {
+		return tr
+	}
+
+	for listen, tr := range cfg.Transfers {
+		if first, last, ok := listenPortRange(listen); ok && first <= port && port <= last {
+			return tr
+		}
+	}
+
+	return nil
+}
+
+// listenPortRange returns the port range of a listen spec like ":5000-5049".
+func listenPortRange(listen string) (first, last int, ok bool) {
+	idx := strings.LastIndex(listen, ":")
+	if idx == -1 || strings.HasPrefix(listen, "unix:") {
+		return
+	}
+
+	first, last, err := config.ParsePortRange(listen[idx+1:])
+	if err != nil {
+		return
+	}
+
+	return first, last, true
+}
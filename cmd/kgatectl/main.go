@@ -30,7 +30,16 @@ func main() {
 	cmd.AddCommand(
 		initCommand(),
 		exposeRemoteCommand(),
+		unexposeRemoteCommand(),
+		listRemoteCommand(),
 		genKeyCommand(),
+		enrollCommand(),
+		clientsCommand(),
+		clientTransfersCommand(),
+		revokeCommand(),
+		rotateCommand(),
+		uninstallCommand(),
+		statusCommand(),
 	)
 
 	cmd.PersistentPreRun = func(cmd *Command, args []string) {
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/mcluseau/kgate/config"
+)
+
+// The policy settings are kept in annotations, so expose-remote can rebuild
+// the policy when the transfers change.
+const (
+	egressToAnnotation          = "kgate/egress-to"
+	ingressFromAnnotation       = "kgate/ingress-from"
+	metricsFromAnnotation       = "kgate/metrics-from"
+	gatewayFromAnnotation       = "kgate/gateway-from"
+	ingressControllerAnnotation = "kgate/ingress-controller-namespace"
+
+	// namespaceNameLabel is set on namespaces since Kubernetes 1.21.
+	namespaceNameLabel = "kubernetes.io/metadata.name"
+)
+
+var (
+	networkPolicy       bool
+	egressTo            []string
+	ingressFrom         []string
+	metricsFrom         []string
+	gatewayFrom         []string
+	ingressControllerNS string
+)
+
+func registerNetworkPolicyFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&networkPolicy, "network-policy", false, "Create a NetworkPolicy restricting the server's traffic (maintained once created)")
+	flags.StringArrayVar(&egressTo, "egress-to", nil, "Peers the server may dial, as namespace:NAME, pods:SELECTOR or cidr:CIDR (repeatable)")
+	flags.StringArrayVar(&ingressFrom, "ingress-from", nil, "Peers allowed to use the exposed services, as namespace:NAME, pods:SELECTOR or cidr:CIDR (repeatable), the server's namespace if none")
+	flags.StringArrayVar(&metricsFrom, "metrics-from", nil, "Peers allowed to reach the server's internal port (status and metrics, also used by kgatectl status through the API server), the server's namespace if none")
+	flags.StringArrayVar(&gatewayFrom, "gateway-from", nil, "Peers allowed to reach the raw TLS gateway port (clients authenticate with their certificate), anyone if none")
+	flags.StringVar(&ingressControllerNS, "ingress-controller-namespace", "", "Namespace of the ingress controller allowed to reach the server (ingress-nginx if never set)")
+}
+
+// validateNetworkPolicyFlags fails early on invalid peers.
+func validateNetworkPolicyFlags() {
+	parsePeers(egressTo)
+	parsePeers(ingressFrom)
+	parsePeers(metricsFrom)
+	parsePeers(gatewayFrom)
+}
+
+// applyNetworkPolicy creates or updates the server's NetworkPolicy for the
+// deployment's transfers. Without --network-policy, it only maintains an
+// existing one.
+func applyNetworkPolicy(dep *apps.Deployment) {
+	policy := &netv1.NetworkPolicy{}
+	err := objects.Get(serverName, policy)
+
+	found := true
+	if errors.IsNotFound(err) {
+		if !networkPolicy {
+			return
+		}
+
+		found = false
+		policy = &netv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        serverName,
+				Namespace:   namespace,
+				Labels:      serverLabels(),
+				Annotations: map[string]string{},
+			},
+		}
+
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	if policy.Annotations == nil {
+		policy.Annotations = map[string]string{}
+	}
+
+	setPolicyAnnotation(policy, egressToAnnotation, strings.Join(egressTo, "\n"), "")
+	setPolicyAnnotation(policy, ingressFromAnnotation, strings.Join(ingressFrom, "\n"), "")
+	setPolicyAnnotation(policy, metricsFromAnnotation, strings.Join(metricsFrom, "\n"), "")
+	setPolicyAnnotation(policy, gatewayFromAnnotation, strings.Join(gatewayFrom, "\n"), "")
+	setPolicyAnnotation(policy, ingressControllerAnnotation, ingressControllerNS, "ingress-nginx")
+
+	policy.Spec = networkPolicySpec(dep, policyPeers{
+		egressTo:     splitPeers(policy.Annotations[egressToAnnotation]),
+		ingressFrom:  splitPeers(policy.Annotations[ingressFromAnnotation]),
+		metricsFrom:  splitPeers(policy.Annotations[metricsFromAnnotation]),
+		gatewayFrom:  splitPeers(policy.Annotations[gatewayFromAnnotation]),
+		controllerNS: policy.Annotations[ingressControllerAnnotation],
+	})
+
+	checkNamespaceLabel()
+
+	if found {
+		log.Print("Updating network policy ", serverName)
+		err = objects.Update(policy)
+	} else {
+		log.Print("Creating network policy ", serverName)
+		err = objects.Create(policy)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setPolicyAnnotation sets the annotation to value if given, to the default
+// value if not set yet.
+func setPolicyAnnotation(policy *netv1.NetworkPolicy, key, value, defaultValue string) {
+	if value != "" {
+		policy.Annotations[key] = value
+	} else if _, ok := policy.Annotations[key]; !ok {
+		policy.Annotations[key] = defaultValue
+	}
+}
+
+func splitPeers(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// checkNamespaceLabel warns on clusters older than 1.21, where namespace:NAME
+// peers (the ingress controller's namespace included) only match namespaces
+// labeled by hand.
+func checkNamespaceLabel() {
+	if rendering() {
+		return
+	}
+
+	client, _ := objects.(*clusterStore).clients()
+	info, err := client.Discovery().ServerVersion()
+	if err != nil {
+		return
+	}
+
+	minor, err := strconv.Atoi(strings.TrimSuffix(info.Minor, "+"))
+	if err != nil || info.Major != "1" || minor >= 21 {
+		return
+	}
+
+	log.Print("Warning: Kubernetes ", info.GitVersion, " doesn't label namespaces with ", namespaceNameLabel,
+		", set it by hand on the namespaces used as namespace:NAME peers and on the ingress controller's")
+}
+
+// policyPeers are the peers of the server's network policy.
+type policyPeers struct {
+	egressTo     []string
+	ingressFrom  []string
+	metricsFrom  []string
+	gatewayFrom  []string
+	controllerNS string
+}
+
+// fromOrNamespace returns the given peers, or the server's namespace.
+func fromOrNamespace(specs []string) []netv1.NetworkPolicyPeer {
+	if len(specs) == 0 {
+		return []netv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}}
+	}
+	return parsePeers(specs)
+}
+
+func networkPolicySpec(dep *apps.Deployment, peers policyPeers) netv1.NetworkPolicySpec {
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dns := intstr.FromInt(53)
+
+	spec := netv1.NetworkPolicySpec{
+		PodSelector: *selector(),
+		PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress, netv1.PolicyTypeEgress},
+		Egress: []netv1.NetworkPolicyEgressRule{
+			{
+				// name resolution of the targets
+				Ports: []netv1.NetworkPolicyPort{
+					{Protocol: &udp, Port: &dns},
+					{Protocol: &tcp, Port: &dns},
+				},
+			},
+		},
+	}
+
+	if len(peers.egressTo) != 0 {
+		spec.Egress = append(spec.Egress, netv1.NetworkPolicyEgressRule{
+			To: parsePeers(peers.egressTo),
+		})
+	}
+
+	// gateway
+	containerPorts := dep.Spec.Template.Spec.Containers[0].Ports
+	for _, port := range containerPorts {
+		p := intstr.FromInt(int(port.ContainerPort))
+
+		switch port.Name {
+		case "http":
+			spec.Ingress = append(spec.Ingress, netv1.NetworkPolicyIngressRule{
+				Ports: []netv1.NetworkPolicyPort{{Port: &p}},
+				From:  parsePeers([]string{"namespace:" + peers.controllerNS}),
+			})
+
+		case "tls":
+			// clients come through a load balancer or a node port, from
+			// anywhere unless restricted
+			spec.Ingress = append(spec.Ingress, netv1.NetworkPolicyIngressRule{
+				Ports: []netv1.NetworkPolicyPort{{Port: &p}},
+				From:  parsePeers(peers.gatewayFrom),
+			})
+
+		case "internal":
+			// status and metrics, for the server's namespace unless given
+			spec.Ingress = append(spec.Ingress, netv1.NetworkPolicyIngressRule{
+				Ports: []netv1.NetworkPolicyPort{{Port: &p}},
+				From:  fromOrNamespace(peers.metricsFrom),
+			})
+		}
+	}
+
+	// exposed services
+	transferPorts := policyTransferPorts(deploymentConfig(dep))
+	if len(transferPorts) != 0 {
+		spec.Ingress = append(spec.Ingress, netv1.NetworkPolicyIngressRule{
+			Ports: transferPorts,
+			From:  fromOrNamespace(peers.ingressFrom),
+		})
+	}
+
+	return spec
+}
+
+// policyTransferPorts returns the ports the server listens on for transfers.
+func policyTransferPorts(cfg *config.Config) []netv1.NetworkPolicyPort {
+	ports := make([]int, 0, len(cfg.LocalTransfers))
+	for port := range cfg.LocalTransfers {
+		ports = append(ports, port)
+	}
+	for listen := range cfg.Transfers {
+		first, last, ok := listenPortRange(listen)
+		if !ok {
+			continue
+		}
+		for port := first; port <= last; port++ {
+			ports = append(ports, port)
+		}
+	}
+
+	sort.Ints(ports)
+
+	result := make([]netv1.NetworkPolicyPort, 0, len(ports))
+	for _, port := range ports {
+		p := intstr.FromInt(port)
+		result = append(result, netv1.NetworkPolicyPort{Port: &p})
+	}
+	return result
+}
+
+func parsePeers(specs []string) []netv1.NetworkPolicyPeer {
+	peers := make([]netv1.NetworkPolicyPeer, 0, len(specs))
+
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			log.Fatal("Invalid network policy peer: ", spec)
+		}
+
+		switch parts[0] {
+		case "namespace":
+			peers = append(peers, netv1.NetworkPolicyPeer{
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{namespaceNameLabel: parts[1]},
+				},
+			})
+
+		case "pods":
+			sel, err := metav1.ParseToLabelSelector(parts[1])
+			if err != nil {
+				log.Fatal("Invalid pod selector in ", spec, ": ", err)
+			}
+			peers = append(peers, netv1.NetworkPolicyPeer{PodSelector: sel})
+
+		case "cidr":
+			if _, _, err := net.ParseCIDR(parts[1]); err != nil {
+				log.Fatal("Invalid CIDR in ", spec, ": ", err)
+			}
+			peers = append(peers, netv1.NetworkPolicyPeer{IPBlock: &netv1.IPBlock{CIDR: parts[1]}})
+
+		default:
+			log.Fatal("Invalid network policy peer: ", spec)
+		}
+	}
+
+	return peers
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	k "github.com/mcluseau/kubeclient"
+	"github.com/spf13/pflag"
+	apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	outputFormat string
+	outputDir    string
+	certManager  bool
+
+	// objects is where the managed objects are read and written.
+	objects objectStore = &clusterStore{}
+)
+
+// objectStore reads and writes the Kubernetes objects managed by kgatectl.
+type objectStore interface {
+	// Get fills obj with the named object, or returns a NotFound error.
+	Get(name string, obj runtime.Object) error
+	Create(obj runtime.Object) error
+	Update(obj runtime.Object) error
+}
+
+func registerOutputFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&outputFormat, "output", "o", "", "Render the manifests as yaml or json instead of applying them")
+	flags.StringVar(&outputDir, "output-dir", "", "Directory where manifests are rendered (one file per object, existing ones are read back), stdout if empty")
+	flags.BoolVar(&certManager, "cert-manager", false, "Render cert-manager objects instead of secrets (requires --output)")
+}
+
+// setupOutput selects the object store from the output flags.
+func setupOutput() {
+	if certManager && outputFormat == "" {
+		log.Fatal("--cert-manager requires --output")
+	}
+
+	switch outputFormat {
+	case "":
+		if outputDir != "" {
+			log.Fatal("--output-dir requires --output")
+		}
+		return
+
+	case "yaml", "json":
+		// ok
+
+	default:
+		log.Fatal("Invalid output format: ", outputFormat)
+	}
+
+	if outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0700); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	objects = &renderStore{
+		format: outputFormat,
+		dir:    outputDir,
+	}
+}
+
+func rendering() bool {
+	_, ok := objects.(*renderStore)
+	return ok
+}
+
+// clusterStore reads and writes objects through the Kubernetes API.
+type clusterStore struct {
+	client kubernetes.Interface
+
+	// raw serves the objects without typed client, like ingresses.
+	raw rest.Interface
+}
+
+func newClusterStore(client kubernetes.Interface, raw rest.Interface) *clusterStore {
+	return &clusterStore{client: client, raw: raw}
+}
+
+// clients returns the store's clients, connecting to the cluster if not set.
+func (s *clusterStore) clients() (kubernetes.Interface, rest.Interface) {
+	if s.client == nil {
+		c := k.Client()
+		s.client, s.raw = c, c.Discovery().RESTClient()
+	}
+	return s.client, s.raw
+}
+
+func (s *clusterStore) Get(name string, obj runtime.Object) (err error) {
+	c, raw := s.clients()
+
+	switch o := obj.(type) {
+	case *apps.Deployment:
+		var res *apps.Deployment
+		if res, err = c.AppsV1().Deployments(namespace).Get(name, getOpts); err == nil {
+			*o = *res
+		}
+	case *corev1.Service:
+		var res *corev1.Service
+		if res, err = c.CoreV1().Services(namespace).Get(name, getOpts); err == nil {
+			*o = *res
+		}
+	case *corev1.Secret:
+		var res *corev1.Secret
+		if res, err = c.CoreV1().Secrets(namespace).Get(name, getOpts); err == nil {
+			*o = *res
+		}
+	case *corev1.ConfigMap:
+		var res *corev1.ConfigMap
+		if res, err = c.CoreV1().ConfigMaps(namespace).Get(name, getOpts); err == nil {
+			*o = *res
+		}
+	case *netv1.NetworkPolicy:
+		var res *netv1.NetworkPolicy
+		if res, err = c.NetworkingV1().NetworkPolicies(namespace).Get(name, getOpts); err == nil {
+			*o = *res
+		}
+	case *unstructured.Unstructured:
+		var ba []byte
+		if ba, err = raw.Get().AbsPath(resourcePath(o.GroupVersionKind(), name)).DoRaw(); err == nil {
+			err = o.UnmarshalJSON(ba)
+		}
+	default:
+		panic(fmt.Errorf("unsupported object type %T", obj))
+	}
+	return
+}
+
+func (s *clusterStore) Create(obj runtime.Object) (err error) {
+	c, raw := s.clients()
+
+	switch o := obj.(type) {
+	case *apps.Deployment:
+		_, err = c.AppsV1().Deployments(namespace).Create(o)
+	case *corev1.Service:
+		_, err = c.CoreV1().Services(namespace).Create(o)
+	case *corev1.Secret:
+		_, err = c.CoreV1().Secrets(namespace).Create(o)
+	case *corev1.ConfigMap:
+		_, err = c.CoreV1().ConfigMaps(namespace).Create(o)
+	case *netv1.NetworkPolicy:
+		_, err = c.NetworkingV1().NetworkPolicies(namespace).Create(o)
+	case *unstructured.Unstructured:
+		err = rawRequest(raw.Post().AbsPath(resourcePath(o.GroupVersionKind(), "")), o)
+	default:
+		panic(fmt.Errorf("unsupported object type %T", obj))
+	}
+	return
+}
+
+func (s *clusterStore) Update(obj runtime.Object) (err error) {
+	c, raw := s.clients()
+
+	switch o := obj.(type) {
+	case *apps.Deployment:
+		_, err = c.AppsV1().Deployments(namespace).Update(o)
+	case *corev1.Service:
+		_, err = c.CoreV1().Services(namespace).Update(o)
+	case *corev1.Secret:
+		_, err = c.CoreV1().Secrets(namespace).Update(o)
+	case *corev1.ConfigMap:
+		_, err = c.CoreV1().ConfigMaps(namespace).Update(o)
+	case *netv1.NetworkPolicy:
+		_, err = c.NetworkingV1().NetworkPolicies(namespace).Update(o)
+	case *unstructured.Unstructured:
+		err = rawRequest(raw.Put().AbsPath(resourcePath(o.GroupVersionKind(), o.GetName())), o)
+	default:
+		panic(fmt.Errorf("unsupported object type %T", obj))
+	}
+	return
+}
+
+func rawRequest(req *rest.Request, obj *unstructured.Unstructured) error {
+	ba, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	return req.Body(ba).Do().Error()
+}
+
+// resourcePath is the API path of a namespaced resource, or of its collection
+// if name is empty.
+func resourcePath(gvk schema.GroupVersionKind, name string) string {
+	path := "/apis/" + gvk.GroupVersion().String()
+	if gvk.Group == "" {
+		path = "/api/" + gvk.Version
+	}
+
+	path += "/namespaces/" + namespace + "/" + resourceName(gvk.Kind)
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// resourceNames are the resource names of the kinds managed by kgatectl.
+var resourceNames = map[string]string{
+	"ConfigMap":     "configmaps",
+	"Deployment":    "deployments",
+	"Ingress":       "ingresses",
+	"NetworkPolicy": "networkpolicies",
+	"Secret":        "secrets",
+	"Service":       "services",
+}
+
+// resourceName returns the resource name of a kind.
+func resourceName(kind string) string {
+	name, ok := resourceNames[kind]
+	if !ok {
+		panic(fmt.Errorf("unsupported kind %s", kind))
+	}
+	return name
+}
+
+// renderStore writes manifests to a directory, or stdout, without touching
+// the cluster. Objects already rendered in the directory are read back.
+type renderStore struct {
+	format string
+	dir    string
+
+	written int
+}
+
+func groupVersionKind(obj runtime.Object) schema.GroupVersionKind {
+	switch obj.(type) {
+	case *apps.Deployment:
+		return apps.SchemeGroupVersion.WithKind("Deployment")
+	case *corev1.Service:
+		return corev1.SchemeGroupVersion.WithKind("Service")
+	case *corev1.Secret:
+		return corev1.SchemeGroupVersion.WithKind("Secret")
+	case *corev1.ConfigMap:
+		return corev1.SchemeGroupVersion.WithKind("ConfigMap")
+	case *netv1.NetworkPolicy:
+		return netv1.SchemeGroupVersion.WithKind("NetworkPolicy")
+	case *unstructured.Unstructured:
+		return obj.GetObjectKind().GroupVersionKind()
+	default:
+		panic(fmt.Errorf("unsupported object type %T", obj))
+	}
+}
+
+func (s *renderStore) path(name string, obj runtime.Object) string {
+	kind := strings.ToLower(groupVersionKind(obj).Kind)
+	return filepath.Join(s.dir, kind+"-"+name+"."+s.format)
+}
+
+func (s *renderStore) Get(name string, obj runtime.Object) error {
+	gvk := groupVersionKind(obj)
+	notFound := errors.NewNotFound(schema.GroupResource{Group: gvk.Group, Resource: gvk.Kind}, name)
+
+	if s.dir == "" {
+		return notFound
+	}
+
+	ba, err := ioutil.ReadFile(s.path(name, obj))
+	if os.IsNotExist(err) {
+		return notFound
+	} else if err != nil {
+		return err
+	}
+
+	return yaml.Unmarshal(ba, obj)
+}
+
+func (s *renderStore) Create(obj runtime.Object) error {
+	return s.write(obj)
+}
+
+func (s *renderStore) Update(obj runtime.Object) error {
+	return s.write(obj)
+}
+
+func (s *renderStore) write(obj runtime.Object) error {
+	obj.GetObjectKind().SetGroupVersionKind(groupVersionKind(obj))
+
+	ba, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if s.format == "yaml" {
+		if ba, err = yaml.JSONToYAML(ba); err != nil {
+			return err
+		}
+	} else {
+		ba = append(ba, '\n')
+	}
+
+	if s.dir == "" {
+		if s.format == "yaml" && s.written != 0 {
+			os.Stdout.Write([]byte("---\n"))
+		}
+		s.written++
+
+		_, err = os.Stdout.Write(ba)
+		return err
+	}
+
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+
+	path := s.path(m.GetName(), obj)
+	log.Print("Writing ", path)
+	return ioutil.WriteFile(path, ba, 0600)
+}
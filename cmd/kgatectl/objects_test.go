@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	restfake "k8s.io/client-go/rest/fake"
+
+	"github.com/mcluseau/kgate/config"
+)
+
+// withStore runs the test against a cluster store of the given clients.
+func withStore(t *testing.T, store *clusterStore) {
+	prevObjects, prevNamespace, prevServer := objects, namespace, serverName
+	t.Cleanup(func() { objects, namespace, serverName = prevObjects, prevNamespace, prevServer })
+
+	objects, namespace, serverName = store, "test", "kgate"
+}
+
+func TestConfigThroughAppsV1(t *testing.T) {
+	client := fake.NewSimpleClientset(&apps.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "kgate", Namespace: "test"},
+		Spec: apps.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name: "kgate",
+						Env:  []corev1.EnvVar{{Name: "CONFIG", Value: `{"LocalTransfers":{"23":{"Target":"as400:23"}}}`}},
+					}},
+				},
+			},
+		},
+	})
+	withStore(t, newClusterStore(client, nil))
+
+	dep, cfg := fetchConfig()
+	if tr := cfg.LocalTransfers[23]; tr == nil || tr.Target != "as400:23" {
+		t.Fatalf("wrong config read: %+v", cfg)
+	}
+
+	cfg.LocalTransfers[5432] = &config.TransferTarget{Target: "db:5432"}
+	setConfig(dep, cfg)
+
+	updated, err := client.AppsV1().Deployments("test").Get("kgate", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr := deploymentConfig(updated).LocalTransfers[5432]; tr == nil || tr.Target != "db:5432" {
+		t.Errorf("config not written: %s", updated.Spec.Template.Spec.Containers[0].Env[0].Value)
+	}
+
+	for _, action := range client.Actions() {
+		if gvr := action.GetResource(); gvr != apps.SchemeGroupVersion.WithResource("deployments") {
+			t.Errorf("%s through %v, expected apps/v1 deployments", action.GetVerb(), gvr)
+		}
+	}
+}
+
+// fakeIngressAPI serves no ingresses, recording the ones created by path.
+func fakeIngressAPI(created map[string]*unstructured.Unstructured) *restfake.RESTClient {
+	return &restfake.RESTClient{
+		NegotiatedSerializer: scheme.Codecs,
+		Client: restfake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{"Content-Type": []string{"application/json"}}
+
+			if req.Method == http.MethodPost {
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+
+				obj := &unstructured.Unstructured{}
+				if err := obj.UnmarshalJSON(body); err != nil {
+					return nil, err
+				}
+				created[req.URL.Path] = obj
+
+				return &http.Response{StatusCode: http.StatusCreated, Header: header, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+			}
+
+			if strings.HasSuffix(req.URL.Path, "/ingresses") {
+				list := []byte(`{"kind":"IngressList","apiVersion":"v1","items":[]}`)
+				return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(bytes.NewReader(list))}, nil
+			}
+
+			status, _ := json.Marshal(metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Reason:   metav1.StatusReasonNotFound,
+				Code:     http.StatusNotFound,
+			})
+			return &http.Response{StatusCode: http.StatusNotFound, Header: header, Body: ioutil.NopCloser(bytes.NewReader(status))}, nil
+		}),
+	}
+}
+
+func TestCreateIngress(t *testing.T) {
+	defer func(v, h string) { ingressAPIVersion, ingressHost = v, h }(ingressAPIVersion, ingressHost)
+	ingressHost = "{{.Name}}.{{.Namespace}}.example.com"
+
+	for _, tc := range []struct {
+		served []string
+		path   string
+	}{
+		{[]string{"networking.k8s.io/v1", "extensions/v1beta1"}, "/apis/networking.k8s.io/v1/namespaces/test/ingresses"},
+		{[]string{"extensions/v1beta1"}, "/apis/extensions/v1beta1/namespaces/test/ingresses"},
+	} {
+		client := fake.NewSimpleClientset()
+		for _, gv := range tc.served {
+			client.Resources = append(client.Resources, &metav1.APIResourceList{
+				GroupVersion: gv,
+				APIResources: []metav1.APIResource{{Name: "ingresses", Namespaced: true, Kind: "Ingress"}},
+			})
+		}
+
+		created := map[string]*unstructured.Unstructured{}
+		withStore(t, newClusterStore(client, fakeIngressAPI(created)))
+		ingressAPIVersion = ""
+
+		createIngress()
+
+		ing := created[tc.path]
+		if ing == nil {
+			t.Errorf("served %v: no ingress created at %s (created: %v)", tc.served, tc.path, created)
+			continue
+		}
+
+		if got, want := ing.GetAPIVersion(), tc.served[0]; got != want {
+			t.Errorf("served %v: got API version %s, want %s", tc.served, got, want)
+		}
+		if hosts, _ := ingressHosts(ing); len(hosts) != 1 || hosts[0] != "kgate.test.example.com" {
+			t.Errorf("served %v: wrong hosts %v", tc.served, hosts)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"log"
+
+	"github.com/spf13/pflag"
+
+	"github.com/mcluseau/kgate/pki"
+)
+
+var (
+	keyAlgorithm = string(pki.DefaultKeyAlgorithm)
+	caValidity   = pki.DefaultCAValidity
+	certValidity = pki.DefaultValidity
+	serverSANs   []string
+)
+
+func registerPKIFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&keyAlgorithm, "key-algorithm", keyAlgorithm, "Algorithm of generated keys (ecdsa-p256, ecdsa-p384, ed25519, rsa-2048, rsa-4096)")
+	registerValidityFlag(flags)
+}
+
+func registerValidityFlag(flags *pflag.FlagSet) {
+	flags.DurationVar(&certValidity, "validity", certValidity, "Validity of issued certificates")
+}
+
+func registerCAFlags(flags *pflag.FlagSet) {
+	flags.DurationVar(&caValidity, "ca-validity", caValidity, "Validity of the CA certificate")
+}
+
+func registerServerSANFlag(flags *pflag.FlagSet) {
+	flags.StringArrayVar(&serverSANs, "san", nil, "Additional SAN of the server certificate: DNS name, IP address or URI (repeatable)")
+}
+
+// generateKey returns a new key with the selected algorithm.
+func generateKey() (key crypto.Signer, keyPEM []byte) {
+	alg, err := pki.ParseKeyAlgorithm(keyAlgorithm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	key, keyPEM, err = pki.GenerateKey(alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return
+}
+
+// newCA returns the key and certificate of a new CA.
+func newCA() (keyPEM, crtPEM []byte) {
+	key, keyPEM := generateKey()
+
+	crtPEM, err := pki.NewCA(key, pki.Options{
+		CommonName: serverName + " CA",
+		Validity:   caValidity,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return
+}
+
+// issueCertificate returns a new key and its certificate, issued by the CA
+// of the secret data.
+func issueCertificate(caData map[string][]byte, commonName string, sans []string, usage x509.ExtKeyUsage) (keyPEM, crtPEM []byte) {
+	key, keyPEM := generateKey()
+	crtPEM = signCertificate(caData, key.Public(), commonName, sans, usage)
+	return
+}
+
+// signCertificate returns a certificate for the public key, issued by the
+// CA of the secret data.
+func signCertificate(caData map[string][]byte, pub crypto.PublicKey, commonName string, sans []string, usage x509.ExtKeyUsage) []byte {
+	ca, err := pki.LoadCA(caData["tls.crt"], caData["tls.key"])
+	if err != nil {
+		log.Fatal("invalid CA: ", err)
+	}
+
+	crtPEM, err := ca.Issue(pub, pki.Options{
+		CommonName:   commonName,
+		SANs:         append([]string{commonName}, sans...),
+		Validity:     certValidity,
+		ExtKeyUsages: []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return crtPEM
+}
+
+// issueServerCertificate returns a new key and certificate for the server.
+func issueServerCertificate(caData map[string][]byte) (keyPEM, crtPEM []byte) {
+	return issueCertificate(caData, serverName, serverSANs, x509.ExtKeyUsageServerAuth)
+}
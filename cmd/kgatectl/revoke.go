@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	revokedKey        = "serials"
+	revokedMountPath  = "/revoked"
+	revokedAnnotation = "kgate/revoked"
+)
+
+var revokedClient string
+
+func revokeCommand() *Command {
+	cmd := &Command{
+		Use: "revoke",
+		Run: revokeRun,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&serverName, "server-name", "kgate", "The server name")
+	flags.StringVar(&revokedClient, "client", "", "The client to revoke")
+	registerOutputFlags(flags)
+
+	return cmd
+}
+
+// revokedConfigMap lists the revoked client serials, mounted into the server.
+func revokedConfigMap() string {
+	return serverName + "-revoked"
+}
+
+func revokeRun(cmd *Command, args []string) {
+	setupOutput()
+
+	if revokedClient == "" {
+		log.Fatal("Client name is required")
+	}
+	validateClientName(revokedClient)
+
+	sec := &corev1.Secret{}
+	if err := objects.Get(clientSecretName(revokedClient), sec); err != nil {
+		log.Fatal(err)
+	}
+
+	serials := clientSerials(sec)
+	if len(serials) == 0 {
+		log.Fatal("No valid certificate in secret ", sec.Name)
+	}
+
+	// every certificate issued to the client, so the ones it was rotated from
+	// don't survive
+	revoked := false
+	for _, serial := range serials {
+		if addRevokedSerial(serial, revokedClient) {
+			log.Print("Revoked client ", revokedClient, " (serial ", serial, ")")
+			revoked = true
+		}
+	}
+
+	if !revoked {
+		log.Print("Client ", revokedClient, " (serials ", strings.Join(serials, ", "), ") is already revoked")
+	} else {
+		if sec.Annotations == nil {
+			sec.Annotations = map[string]string{}
+		}
+		sec.Annotations[revokedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		if err := objects.Update(sec); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ensureRevocationMount()
+}
+
+// addRevokedSerial adds the serial to the revocation list, returning false
+// if it was already there.
+func addRevokedSerial(serial, name string) bool {
+	cm := &corev1.ConfigMap{}
+	err := objects.Get(revokedConfigMap(), cm)
+
+	found := true
+	if errors.IsNotFound(err) {
+		found = false
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      revokedConfigMap(),
+				Namespace: namespace,
+				Labels:    ownerLabels(),
+			},
+		}
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+
+	if revokedSerials(cm)[serial] {
+		return false
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	cm.Data[revokedKey] += fmt.Sprintf("%s # %s, revoked on %s by %s\n", serial, name, now, os.Getenv("USER"))
+
+	if found {
+		err = objects.Update(cm)
+	} else {
+		err = objects.Create(cm)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return true
+}
+
+// ensureRevocationMount mounts the revocation list into servers deployed
+// before revocation support.
+func ensureRevocationMount() {
+	dep, cfg := fetchConfig()
+	if addRevocationMount(&dep.Spec.Template.Spec) {
+		log.Print("Mounting the revoked serials into ", serverName, " (will restart the server)")
+		setConfig(dep, cfg)
+	}
+}
+
+// revokedSerials parses the serials of the revocation list.
+func revokedSerials(cm *corev1.ConfigMap) map[string]bool {
+	serials := map[string]bool{}
+	for _, line := range strings.Split(cm.Data[revokedKey], "\n") {
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			serials[strings.ToLower(line)] = true
+		}
+	}
+	return serials
+}
+
+// addRevocationMount mounts the revocation list into the server if needed,
+// returning true if the spec changed.
+func addRevocationMount(spec *corev1.PodSpec) bool {
+	for _, vol := range spec.Volumes {
+		if vol.Name == "revoked" {
+			return false
+		}
+	}
+
+	optional := true
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "revoked",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: revokedConfigMap()},
+				Optional:             &optional,
+			},
+		},
+	})
+
+	cnt := &spec.Containers[0]
+	cnt.VolumeMounts = append(cnt.VolumeMounts, corev1.VolumeMount{
+		Name:      "revoked",
+		MountPath: revokedMountPath,
+		ReadOnly:  true,
+	})
+	cnt.Args = append(cnt.Args, "--revoked="+revokedMountPath+"/"+revokedKey)
+
+	return true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRevokeRotatedClient(t *testing.T) {
+	defer func(v string) { revokedClient = v }(revokedClient)
+
+	client := fake.NewSimpleClientset(&apps.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "kgate", Namespace: "test"},
+		Spec: apps.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "kgate"}}},
+			},
+		},
+	})
+	withStore(t, newClusterStore(client, nil))
+
+	caKey, caCrt := newCA()
+	caData := map[string][]byte{"tls.key": caKey, "tls.crt": caCrt}
+
+	// issued then rotated, without --revoke-previous
+	sec := getOrCreateClient("alice", caData)
+	first := parseCertificatePEM(sec.Data["tls.crt"]).SerialNumber.Text(16)
+
+	issueClientCertificate(sec, "alice", caData)
+	if err := objects.Update(sec); err != nil {
+		t.Fatal(err)
+	}
+	current := parseCertificatePEM(sec.Data["tls.crt"]).SerialNumber.Text(16)
+
+	if got := clientSerials(sec); len(got) != 2 || got[0] != first || got[1] != current {
+		t.Fatalf("got serials %v, want [%s %s]", got, first, current)
+	}
+
+	revokedClient = "alice"
+	revokeRun(nil, nil)
+
+	cm, err := client.CoreV1().ConfigMaps("test").Get(revokedConfigMap(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := revokedSerials(cm)
+	for _, serial := range []string{first, current} {
+		if !revoked[serial] {
+			t.Errorf("serial %s not revoked: %q", serial, cm.Data[revokedKey])
+		}
+	}
+}
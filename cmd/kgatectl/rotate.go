@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/x509"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mcluseau/kgate/pki"
+)
+
+const rolloverAnnotation = "kgate/ca-rollover"
+
+var (
+	rotateServer   bool
+	rotateClients  []string
+	rotateCA       bool
+	finishCA       bool
+	revokePrevious bool
+	forceRotate    bool
+)
+
+func rotateCommand() *Command {
+	cmd := &Command{
+		Use: "rotate",
+		Run: rotateRun,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&serverName, "server-name", "kgate", "The server name")
+	flags.BoolVar(&rotateServer, "server", false, "Reissue the server certificate (reloaded by the server without a restart)")
+	flags.StringArrayVar(&rotateClients, "client", nil, "Reissue a client certificate and write its new configuration (repeatable)")
+	flags.BoolVar(&rotateCA, "ca", false, "Start a CA rollover: create a new CA, trusted along with the current one")
+	flags.BoolVar(&finishCA, "finish-ca", false, "Finish a CA rollover: drop the previous CA and reissue the server certificate")
+	flags.BoolVar(&revokePrevious, "revoke-previous", false, "Revoke the replaced client certificates")
+	flags.BoolVar(&forceRotate, "force", false, "Rotate even if clients would be cut off")
+	flags.StringVar(&clientGateway, "gw", "", "Gateway URL for the clients, found from the server's exposure if empty")
+	registerPKIFlags(flags)
+	registerBundleFlags(flags)
+	registerCAFlags(flags)
+	registerServerSANFlag(flags)
+	registerIngressAPIFlag(flags)
+
+	return cmd
+}
+
+func rotateRun(cmd *Command, args []string) {
+	secretCA = serverName + "-ca"
+	secretServer = serverName + "-server"
+
+	if !rotateServer && len(rotateClients) == 0 && !rotateCA && !finishCA {
+		log.Fatal("Nothing to rotate (--server, --client, --ca or --finish-ca)")
+	}
+	if rotateCA && finishCA {
+		log.Fatal("--ca and --finish-ca are exclusive")
+	}
+	for _, name := range rotateClients {
+		validateClientName(name)
+	}
+
+	secCA := &corev1.Secret{}
+	if err := objects.Get(secretCA, secCA); err != nil {
+		log.Fatal(err)
+	}
+
+	switch {
+	case rotateCA:
+		startCARollover(secCA)
+
+	case finishCA:
+		finishCARollover(secCA)
+		rotateServerCertificate(secCA)
+
+	case rotateServer:
+		// clients may not trust the new CA yet
+		if caRollover(secCA) && !forceRotate {
+			log.Fatal("A CA rollover is in progress, the server certificate will be reissued by --finish-ca")
+		}
+		rotateServerCertificate(secCA)
+	}
+
+	if len(rotateClients) == 0 {
+		return
+	}
+
+	url := clientGateway
+	if url == "" {
+		url = gatewayURL()
+	}
+
+	for _, name := range rotateClients {
+		sec := rotateClientCertificate(name, secCA)
+		writeClientBundle(sec, secCA, url)
+	}
+}
+
+// caRollover tells if the CA secret holds the previous CA along the new one.
+func caRollover(secCA *corev1.Secret) bool {
+	cas, err := pki.ParseCertificates(secCA.Data["tls.crt"])
+	if err != nil {
+		log.Fatal("invalid CA certificate: ", err)
+	}
+	return len(cas) > 1
+}
+
+// startCARollover replaces the CA key and puts the new CA certificate first
+// in the CA secret, keeping the previous one: the server trusts both, and so
+// do the clients configured from then on.
+func startCARollover(secCA *corev1.Secret) {
+	if caRollover(secCA) {
+		log.Fatal("A CA rollover is already in progress, finish it with --finish-ca")
+	}
+
+	log.Print("Creating a new CA")
+
+	keyPEM, crtPEM := newCA()
+
+	secCA.Data["tls.key"] = keyPEM
+	secCA.Data["tls.crt"] = append(crtPEM, secCA.Data["tls.crt"]...)
+
+	if secCA.Annotations == nil {
+		secCA.Annotations = map[string]string{}
+	}
+	secCA.Annotations[rolloverAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+	if err := objects.Update(secCA); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("The new CA is trusted along with the previous one: rotate every client (rotate --client NAME), then finish with rotate --finish-ca")
+}
+
+// finishCARollover drops the previous CA from the CA secret.
+func finishCARollover(secCA *corev1.Secret) {
+	cas, err := pki.ParseCertificates(secCA.Data["tls.crt"])
+	if err != nil {
+		log.Fatal("invalid CA certificate: ", err)
+	}
+	if len(cas) < 2 {
+		log.Fatal("No CA rollover in progress")
+	}
+
+	// the clients not rotated yet would be rejected, and wouldn't trust the
+	// new server certificate
+	stale := []string{}
+	for name, sec := range clientSecrets() {
+		if _, revoked := sec.Annotations[revokedAnnotation]; revoked {
+			continue
+		}
+
+		crt := parseCertificatePEM(sec.Data["tls.crt"])
+		if crt == nil || pki.Verify(crt, cas[:1], x509.ExtKeyUsageClientAuth) != nil {
+			stale = append(stale, name)
+		}
+	}
+
+	if len(stale) != 0 {
+		if !forceRotate {
+			log.Fatal("Clients not rotated yet: ", strings.Join(stale, ", "), " (rotate them, or use --force to cut them off)")
+		}
+		log.Print("Cutting off clients not rotated yet: ", strings.Join(stale, ", "))
+	}
+
+	secCA.Data["tls.crt"] = pki.EncodeCertificates(cas[0])
+	delete(secCA.Annotations, rolloverAnnotation)
+
+	if err := objects.Update(secCA); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("Previous CA dropped")
+}
+
+func rotateServerCertificate(secCA *corev1.Secret) {
+	sec := &corev1.Secret{}
+	if err := objects.Get(secretServer, sec); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("Reissuing the server certificate")
+
+	sec.Data["tls.key"], sec.Data["tls.crt"] = issueServerCertificate(secCA.Data)
+
+	if err := objects.Update(sec); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("The server will load it once its secret volume is refreshed (usually within a minute)")
+}
+
+func rotateClientCertificate(name string, secCA *corev1.Secret) *corev1.Secret {
+	sec := &corev1.Secret{}
+	if err := objects.Get(clientSecretName(name), sec); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, revoked := sec.Annotations[revokedAnnotation]; revoked {
+		if !forceRotate {
+			log.Fatal("Client ", name, " is revoked (use --force to issue it a new certificate)")
+		}
+		delete(sec.Annotations, revokedAnnotation)
+	}
+
+	if _, ok := sec.Data["tls.key"]; !ok {
+		log.Fatal("Client ", name, " enrolled with its own key, it has to enroll again")
+	}
+
+	previous := parseCertificatePEM(sec.Data["tls.crt"])
+
+	log.Print("Reissuing the certificate of client ", name)
+
+	if sec.Annotations == nil {
+		sec.Annotations = map[string]string{}
+	}
+	issueClientCertificate(sec, name, secCA.Data)
+
+	if err := objects.Update(sec); err != nil {
+		log.Fatal(err)
+	}
+
+	if previous != nil && revokePrevious {
+		serial := previous.SerialNumber.Text(16)
+		if addRevokedSerial(serial, name) {
+			log.Print("Revoked the previous certificate of client ", name, " (serial ", serial, ")")
+		}
+		ensureRevocationMount()
+	}
+
+	return sec
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	k "github.com/mcluseau/kubeclient"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mcluseau/kgate/common"
+)
+
+func statusCommand() *Command {
+	cmd := &Command{
+		Use: "status",
+		Run: statusRun,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&serverName, "server-name", "kgate", "The server name")
+
+	return cmd
+}
+
+func statusRun(cmd *Command, args []string) {
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+
+	// deployment
+	dep, cfg := fetchConfig()
+
+	replicas := int32(1)
+	if dep.Spec.Replicas != nil {
+		replicas = *dep.Spec.Replicas
+	}
+
+	fmt.Fprintf(out, "Deployment:\t%s (%d/%d ready, image %s)\n", dep.Name,
+		dep.Status.ReadyReplicas, replicas, dep.Spec.Template.Spec.Containers[0].Image)
+
+	// pods
+	pods, err := k.Client().CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: "app=" + serverName,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintln(out, "\nPods:")
+	if len(pods.Items) == 0 {
+		fmt.Fprintln(out, "  (none)")
+	}
+	for _, pod := range pods.Items {
+		fmt.Fprintf(out, "  %s\t%s\t%s\n", pod.Name, pod.Status.Phase, podReadiness(&pod))
+	}
+
+	// transfers
+	fmt.Fprintln(out, "\nTransfers:")
+	transfers := make([]string, 0, len(cfg.LocalTransfers)+len(cfg.Transfers))
+	for port, tr := range cfg.LocalTransfers {
+		transfers = append(transfers, fmt.Sprintf("  :%d\t-> %s", port, strings.Join(tr.AllTargets(), ", ")))
+	}
+	for listen, tr := range cfg.Transfers {
+		transfers = append(transfers, fmt.Sprintf("  %s\t-> %s", listen, strings.Join(tr.AllTargets(), ", ")))
+	}
+	sort.Strings(transfers)
+	if len(transfers) == 0 {
+		fmt.Fprintln(out, "  (none)")
+	}
+	for _, tr := range transfers {
+		fmt.Fprintln(out, tr)
+	}
+
+	// services
+	services, err := k.Client().CoreV1().Services(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintln(out, "\nServices:")
+	for _, svc := range services.Items {
+		if svc.Spec.Selector["app"] != serverName {
+			continue
+		}
+
+		ports := make([]string, 0, len(svc.Spec.Ports))
+		for _, port := range svc.Spec.Ports {
+			ports = append(ports, fmt.Sprintf("%d->%s", port.Port, port.TargetPort.String()))
+		}
+		fmt.Fprintf(out, "  %s\t%s\t%s\n", svc.Name, svc.Spec.Type, strings.Join(ports, " "))
+	}
+
+	// ingress
+	ing := newIngress()
+	if err := objects.Get(serverName, ing); err == nil {
+		hosts, _ := ingressHosts(ing)
+		fmt.Fprintf(out, "\nIngress:\t%s (%s, %s)\n", ing.GetName(), strings.Join(hosts, ", "), ing.GetAPIVersion())
+	} else {
+		fmt.Fprintf(out, "\nIngress:\t%v\n", err)
+	}
+
+	// certificates
+	fmt.Fprintln(out, "\nCertificates:")
+	for _, name := range []string{serverName + "-ca", serverName + "-server"} {
+		sec, err := k.Client().CoreV1().Secrets(namespace).Get(name, getOpts)
+		if err != nil {
+			fmt.Fprintf(out, "  %s\t%v\n", name, err)
+			continue
+		}
+
+		expiry := certificateExpiry(sec)
+		if since, ok := sec.Annotations[rolloverAnnotation]; ok {
+			expiry += ", CA rollover in progress since " + since
+		}
+
+		fmt.Fprintf(out, "  %s\t%s\n", name, expiry)
+	}
+
+	clients := clientSecrets()
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sec := clients[name]
+		fmt.Fprintf(out, "  %s\t%s (client %s)\n", sec.Name, certificateExpiry(&sec), name)
+	}
+
+	// client sessions
+	fmt.Fprint(out, "\nClients:\t")
+	status, err := serverStatus()
+	if err != nil {
+		fmt.Fprintf(out, "unknown (%v)\n", err)
+		return
+	}
+
+	sessions := status.Sessions
+	if sessions == nil && status.Session.Connected {
+		// older servers only tell the current session
+		sessions = []common.SessionInfo{status.Session}
+	}
+
+	if len(sessions) == 0 {
+		fmt.Fprintln(out, "none connected")
+		return
+	}
+
+	fmt.Fprintln(out)
+	for _, s := range sessions {
+		fmt.Fprintf(out, "  %s\tconnected since %s, rtt %s\n", s.Peer, s.Since.Format(time.RFC3339), s.RTT)
+	}
+}
+
+func podReadiness(pod *corev1.Pod) string {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			return "ready"
+		}
+	}
+	return "not ready"
+}
+
+func certificateExpiry(sec *corev1.Secret) string {
+	block, _ := pem.Decode(sec.Data["tls.crt"])
+	if block == nil {
+		return "no certificate"
+	}
+
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "invalid certificate: " + err.Error()
+	}
+
+	left := time.Until(crt.NotAfter)
+	if left < 0 {
+		return fmt.Sprintf("EXPIRED on %s", crt.NotAfter.Format("2006-01-02"))
+	}
+
+	return fmt.Sprintf("expires on %s (in %d days)", crt.NotAfter.Format("2006-01-02"), int(left.Hours()/24))
+}
+
+type serverStatusResponse struct {
+	Session  common.SessionInfo   `json:"session"`
+	Sessions []common.SessionInfo `json:"sessions"`
+}
+
+// serverStatus queries the server's status endpoint through the API server,
+// on the internal port.
+func serverStatus() (*serverStatusResponse, error) {
+	ba, err := k.Client().CoreV1().Services(namespace).
+		ProxyGet("http", serverName, "internal", "/status", nil).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &serverStatusResponse{}
+	if err := json.Unmarshal(ba, status); err != nil {
+		return nil, errors.New("invalid status response: " + err.Error())
+	}
+
+	return status, nil
+}
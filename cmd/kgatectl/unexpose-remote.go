@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+
+	k "github.com/mcluseau/kubeclient"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mcluseau/kgate/config"
+)
+
+func unexposeRemoteCommand() *Command {
+	cmd := &Command{
+		Use: "unexpose-remote",
+		Run: unexposeRemoteRun,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&serverName, "server-name", "kgate", "The server name")
+	flags.StringVar(&serviceName, "service", "", "Local service name")
+	flags.StringVar(&servicePort, "service-port", "", "Local service port (or port range) to remove, all ports if empty")
+
+	return cmd
+}
+
+func unexposeRemoteRun(cmd *Command, args []string) {
+	if serviceName == "" {
+		log.Fatal("Service name is required")
+	}
+
+	first, last := 0, 65535
+	if servicePort != "" {
+		var err error
+		first, last, err = config.ParsePortRange(servicePort)
+		if err != nil {
+			log.Fatal("Invalid service port: ", err)
+		}
+	}
+
+	services := k.Client().CoreV1().Services(namespace)
+
+	svc, err := services.Get(serviceName, getOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !exposesTransfers(svc) {
+		log.Fatal("Service ", serviceName, " doesn't expose ", serverName)
+	}
+
+	// update the service
+	removedLocal := map[int]bool{}
+	kept := make([]corev1.ServicePort, 0, len(svc.Spec.Ports))
+
+	for _, port := range svc.Spec.Ports {
+		if int(port.Port) >= first && int(port.Port) <= last {
+			removedLocal[port.TargetPort.IntValue()] = true
+			continue
+		}
+		kept = append(kept, port)
+	}
+
+	if len(removedLocal) == 0 {
+		log.Fatal("No port of service ", serviceName, " matches ", servicePort)
+	}
+
+	if len(kept) == 0 {
+		log.Print("Deleting service ", serviceName)
+		if err := services.Delete(serviceName, nil); err != nil {
+			log.Fatal(err)
+		}
+
+	} else {
+		svc.Spec.Ports = kept
+		if _, err := services.Update(svc); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// remove the transfers no other service port uses
+	used := map[int]bool{}
+	for _, s := range remoteServices() {
+		for _, port := range s.Spec.Ports {
+			used[port.TargetPort.IntValue()] = true
+		}
+	}
+
+	dep, cfg := fetchConfig()
+	changed := false
+
+	for port := range removedLocal {
+		if used[port] {
+			continue
+		}
+
+		if _, ok := cfg.LocalTransfers[port]; ok {
+			log.Print("Removing transfer on port ", port)
+			delete(cfg.LocalTransfers, port)
+			changed = true
+		}
+	}
+
+	for listen := range cfg.Transfers {
+		rangeFirst, rangeLast, ok := listenPortRange(listen)
+		if !ok {
+			continue
+		}
+
+		stillUsed, removed := false, false
+		for port := rangeFirst; port <= rangeLast; port++ {
+			stillUsed = stillUsed || used[port]
+			removed = removed || removedLocal[port]
+		}
+
+		if removed && !stillUsed {
+			log.Print("Removing transfer on ", listen)
+			delete(cfg.Transfers, listen)
+			changed = true
+		}
+	}
+
+	if changed {
+		setConfig(dep, cfg)
+		applyNetworkPolicy(dep)
+	}
+}
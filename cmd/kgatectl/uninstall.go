@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	dryRun        bool
+	deleteSecrets bool
+)
+
+func uninstallCommand() *Command {
+	cmd := &Command{
+		Use: "uninstall",
+		Run: uninstallRun,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&serverName, "server-name", "kgate", "The server name")
+	flags.BoolVar(&dryRun, "dry-run", false, "Only list what would be deleted")
+	flags.BoolVar(&deleteSecrets, "delete-secrets", false, "Also delete the CA, server and client secrets, and the revoked serials")
+
+	return cmd
+}
+
+type ownedObject struct {
+	kind, name string
+	delete     func() error
+
+	// kept objects are only listed, as they go with the secrets
+	kept bool
+}
+
+// ownedSet collects the objects to delete, once each.
+type ownedSet struct {
+	objects []ownedObject
+	seen    map[string]bool
+}
+
+func (s *ownedSet) add(kind, name string, delete func() error) {
+	key := kind + "/" + name
+	if s.seen[key] {
+		return
+	}
+	s.seen[key] = true
+
+	// the revoked serials must outlive the certificates they revoke
+	kept := !deleteSecrets && kind == "config map" && name == revokedConfigMap()
+
+	s.objects = append(s.objects, ownedObject{kind, name, delete, kept})
+}
+
+func uninstallRun(cmd *Command, args []string) {
+	client, raw := objects.(*clusterStore).clients()
+
+	owned := listOwned(client, raw)
+
+	if len(owned) == 0 {
+		log.Print("Nothing managed by kgatectl for ", serverName, " (", ownerSelector(), " or app=", serverName, ")")
+		return
+	}
+
+	for _, obj := range owned {
+		if obj.kept {
+			log.Print("Keeping ", obj.kind, " ", obj.name, " (--delete-secrets to delete it)")
+			continue
+		}
+
+		if dryRun {
+			log.Print("Would delete ", obj.kind, " ", obj.name)
+			continue
+		}
+
+		log.Print("Deleting ", obj.kind, " ", obj.name)
+		if err := obj.delete(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// listOwned lists the server's objects, by their owner labels and, for the
+// objects created before them, by their well-known names.
+func listOwned(client kubernetes.Interface, raw rest.Interface) []ownedObject {
+	listOpts := metav1.ListOptions{LabelSelector: ownerSelector()}
+
+	background := metav1.DeletePropagationBackground
+	deleteOpts := &metav1.DeleteOptions{PropagationPolicy: &background}
+
+	owned := &ownedSet{seen: map[string]bool{}}
+
+	deploys := client.AppsV1().Deployments(namespace)
+	depList, err := deploys.List(listOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, obj := range depList.Items {
+		name := obj.Name
+		owned.add("deployment", name, func() error { return deploys.Delete(name, deleteOpts) })
+	}
+
+	ingKind := newIngress().GroupVersionKind()
+	ba, err := raw.Get().AbsPath(resourcePath(ingKind, "")).Param("labelSelector", listOpts.LabelSelector).DoRaw()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ingList := &unstructured.UnstructuredList{}
+	if err := ingList.UnmarshalJSON(ba); err != nil {
+		log.Fatal(err)
+	}
+	deleteBody, err := json.Marshal(deleteOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deleteIngress := func(name string) func() error {
+		return func() error {
+			return raw.Delete().AbsPath(resourcePath(ingKind, name)).Body(deleteBody).Do().Error()
+		}
+	}
+	for _, obj := range ingList.Items {
+		owned.add("ingress", obj.GetName(), deleteIngress(obj.GetName()))
+	}
+
+	policies := client.NetworkingV1().NetworkPolicies(namespace)
+	policyList, err := policies.List(listOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, obj := range policyList.Items {
+		name := obj.Name
+		owned.add("network policy", name, func() error { return policies.Delete(name, deleteOpts) })
+	}
+
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	cmList, err := configMaps.List(listOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, obj := range cmList.Items {
+		name := obj.Name
+		owned.add("config map", name, func() error { return configMaps.Delete(name, deleteOpts) })
+	}
+
+	services := client.CoreV1().Services(namespace)
+	svcList, err := services.List(listOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, obj := range svcList.Items {
+		name := obj.Name
+		owned.add("service", name, func() error { return services.Delete(name, deleteOpts) })
+	}
+
+	secrets := client.CoreV1().Secrets(namespace)
+	if deleteSecrets {
+		secList, err := secrets.List(listOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, obj := range secList.Items {
+			name := obj.Name
+			owned.add("secret", name, func() error { return secrets.Delete(name, deleteOpts) })
+		}
+	}
+
+	// objects created before the owner labels only carry app=<server> on the
+	// deployment's pods and the services' selectors; the deployment confirms
+	// the others, known by their names.
+	dep, err := deploys.Get(serverName, getOpts)
+	if errors.IsNotFound(err) {
+		return owned.objects
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if dep.Spec.Template.Labels["app"] != serverName {
+		log.Print("Deployment ", serverName, " isn't labeled app=", serverName, ", not looking for unlabeled objects")
+		return owned.objects
+	}
+	owned.add("deployment", serverName, func() error { return deploys.Delete(serverName, deleteOpts) })
+
+	svcList, err = services.List(metav1.ListOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, obj := range svcList.Items {
+		if obj.Spec.Selector["app"] != serverName {
+			continue
+		}
+		name := obj.Name
+		owned.add("service", name, func() error { return services.Delete(name, deleteOpts) })
+	}
+
+	// exists tells if the named object exists, failing on other errors.
+	exists := func(err error) bool {
+		if errors.IsNotFound(err) {
+			return false
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		return true
+	}
+
+	if exists(raw.Get().AbsPath(resourcePath(ingKind, serverName)).Do().Error()) {
+		owned.add("ingress", serverName, deleteIngress(serverName))
+	}
+
+	if _, err := policies.Get(serverName, getOpts); exists(err) {
+		owned.add("network policy", serverName, func() error { return policies.Delete(serverName, deleteOpts) })
+	}
+
+	for _, name := range []string{revokedConfigMap(), clientTransfersConfigMap()} {
+		name := name
+		if _, err := configMaps.Get(name, getOpts); exists(err) {
+			owned.add("config map", name, func() error { return configMaps.Delete(name, deleteOpts) })
+		}
+	}
+
+	if deleteSecrets {
+		for _, name := range []string{serverName + "-ca", serverName + "-server", clientSecretName(defaultClient)} {
+			name := name
+			if _, err := secrets.Get(name, getOpts); exists(err) {
+				owned.add("secret", name, func() error { return secrets.Delete(name, deleteOpts) })
+			}
+		}
+	}
+
+	return owned.objects
+}
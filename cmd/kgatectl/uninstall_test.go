@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// listed returns the kind/name of the objects uninstall would delete.
+func listed(t *testing.T, objs ...runtime.Object) []string {
+	defer func(v string) { ingressAPIVersion = v }(ingressAPIVersion)
+	ingressAPIVersion = "networking.k8s.io/v1"
+
+	client := fake.NewSimpleClientset(objs...)
+	raw := fakeIngressAPI(map[string]*unstructured.Unstructured{})
+	withStore(t, newClusterStore(client, raw))
+
+	names := []string{}
+	for _, obj := range listOwned(client, raw) {
+		name := obj.kind + "/" + obj.name
+		if obj.kept {
+			name += " (kept)"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func objectMeta(name string, labels map[string]string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: name, Namespace: "test", Labels: labels}
+}
+
+func legacyObjects() []runtime.Object {
+	return []runtime.Object{
+		&apps.Deployment{
+			ObjectMeta: objectMeta("kgate", nil),
+			Spec: apps.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "kgate"}}},
+			},
+		},
+		&corev1.Service{ObjectMeta: objectMeta("kgate", nil), Spec: corev1.ServiceSpec{Selector: map[string]string{"app": "kgate"}}},
+		&corev1.Service{ObjectMeta: objectMeta("as400", nil), Spec: corev1.ServiceSpec{Selector: map[string]string{"app": "kgate"}}},
+		&corev1.Service{ObjectMeta: objectMeta("other", nil), Spec: corev1.ServiceSpec{Selector: map[string]string{"app": "other"}}},
+		&corev1.Secret{ObjectMeta: objectMeta("kgate-ca", nil)},
+		&corev1.Secret{ObjectMeta: objectMeta("kgate-client", nil)},
+		&corev1.Secret{ObjectMeta: objectMeta("other", nil)},
+	}
+}
+
+func TestUninstallLegacyObjects(t *testing.T) {
+	defer func(v bool) { deleteSecrets = v }(deleteSecrets)
+
+	for _, tc := range []struct {
+		deleteSecrets bool
+		want          []string
+	}{
+		{false, []string{"deployment/kgate", "service/as400", "service/kgate"}},
+		{true, []string{"deployment/kgate", "secret/kgate-ca", "secret/kgate-client", "service/as400", "service/kgate"}},
+	} {
+		deleteSecrets = tc.deleteSecrets
+
+		got := listed(t, legacyObjects()...)
+		if len(got) != len(tc.want) {
+			t.Errorf("delete secrets %v: got %v, want %v", tc.deleteSecrets, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("delete secrets %v: got %v, want %v", tc.deleteSecrets, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestUninstallKeepsRevoked(t *testing.T) {
+	defer func(v bool) { deleteSecrets = v }(deleteSecrets)
+
+	owner := map[string]string{managedByLabel: managedBy, instanceLabel: "kgate"}
+
+	for _, tc := range []struct {
+		deleteSecrets bool
+		want          []string
+	}{
+		{false, []string{"config map/kgate-client-transfers", "config map/kgate-revoked (kept)"}},
+		{true, []string{"config map/kgate-client-transfers", "config map/kgate-revoked", "secret/kgate-ca"}},
+	} {
+		deleteSecrets = tc.deleteSecrets
+
+		got := listed(t,
+			&corev1.ConfigMap{ObjectMeta: objectMeta("kgate-revoked", owner)},
+			&corev1.ConfigMap{ObjectMeta: objectMeta("kgate-client-transfers", owner)},
+			&corev1.Secret{ObjectMeta: objectMeta("kgate-ca", owner)},
+		)
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("delete secrets %v: got %v, want %v", tc.deleteSecrets, got, tc.want)
+		}
+	}
+}
+
+func TestUninstallUnconfirmedDeployment(t *testing.T) {
+	// a deployment of the same name that isn't the server's
+	got := listed(t,
+		&apps.Deployment{ObjectMeta: objectMeta("kgate", nil)},
+		&corev1.Service{ObjectMeta: objectMeta("kgate", nil), Spec: corev1.ServiceSpec{Selector: map[string]string{"app": "kgate"}}},
+	)
+	if len(got) != 0 {
+		t.Errorf("nothing should be listed, got %v", got)
+	}
+}
+
+func TestUninstallLabeledOnce(t *testing.T) {
+	got := listed(t,
+		&apps.Deployment{
+			ObjectMeta: objectMeta("kgate", map[string]string{managedByLabel: managedBy, instanceLabel: "kgate"}),
+			Spec: apps.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "kgate"}}},
+			},
+		},
+	)
+	if len(got) != 1 || got[0] != "deployment/kgate" {
+		t.Errorf("the labeled deployment should be listed once, got %v", got)
+	}
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/mcluseau/kgate/config"
+)
+
+// balancer orders the targets of a listener according to its strategy. The
+// listening side sends the ordered targets, and the dialing side tries them
+// in that order.
+type balancer struct {
+	strategy string
+	targets  []string
+
+	mutex  sync.Mutex
+	next   int
+	active []int
+}
+
+func newBalancer(strategy string, targets []string) *balancer {
+	return &balancer{
+		strategy: strategy,
+		targets:  targets,
+		active:   make([]int, len(targets)),
+	}
+}
+
+// order returns the target indices in the order they should be tried.
+func (b *balancer) order(source string) []int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	n := len(b.targets)
+
+	start := 0
+	switch b.strategy {
+	case config.RoundRobin:
+		start = b.next
+		b.next = (b.next + 1) % n
+
+	case config.SourceHash:
+		host, _, err := net.SplitHostPort(source)
+		if err != nil {
+			host = source
+		}
+		h := fnv.New32a()
+		h.Write([]byte(host))
+		start = int(h.Sum32() % uint32(n))
+	}
+
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = (start + i) % n
+	}
+
+	if b.strategy == config.LeastConnections {
+		sort.SliceStable(indices, func(i, j int) bool {
+			return b.active[indices[i]] < b.active[indices[j]]
+		})
+	}
+
+	return indices
+}
+
+// orderedTargets returns the targets in the order they should be tried, and
+// the index of the first one.
+func (b *balancer) orderedTargets(source string) (targets []string, first int) {
+	indices := b.order(source)
+
+	targets = make([]string, len(indices))
+	for i, idx := range indices {
+		targets[i] = b.targets[idx]
+	}
+	return targets, indices[0]
+}
+
+func (b *balancer) acquire(idx int) {
+	b.mutex.Lock()
+	b.active[idx]++
+	b.mutex.Unlock()
+}
+
+func (b *balancer) release(idx int) {
+	b.mutex.Lock()
+	b.active[idx]--
+	b.mutex.Unlock()
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mcluseau/kgate/config"
+)
+
+func TestBalancerOrder(t *testing.T) {
+	targets := []string{"a:1", "b:1", "c:1"}
+
+	for _, tc := range []struct {
+		strategy string
+		want     [][]int
+	}{
+		{"", [][]int{{0, 1, 2}, {0, 1, 2}, {0, 1, 2}}},
+		{config.FirstAvailable, [][]int{{0, 1, 2}, {0, 1, 2}}},
+		{config.RoundRobin, [][]int{{0, 1, 2}, {1, 2, 0}, {2, 0, 1}, {0, 1, 2}}},
+	} {
+		b := newBalancer(tc.strategy, targets)
+		for i, want := range tc.want {
+			if got := b.order("10.0.0.1:1234"); !reflect.DeepEqual(got, want) {
+				t.Errorf("%q call %d: got %v, want %v", tc.strategy, i, got, want)
+			}
+		}
+	}
+}
+
+func TestBalancerSourceHash(t *testing.T) {
+	b := newBalancer(config.SourceHash, []string{"a:1", "b:1", "c:1"})
+
+	first := b.order("10.0.0.1:1234")
+	if got := b.order("10.0.0.1:5678"); !reflect.DeepEqual(got, first) {
+		t.Errorf("same host should get the same order: %v != %v", got, first)
+	}
+
+	// the other targets follow for failover
+	for i := range first {
+		if first[i] != (first[0]+i)%3 {
+			t.Errorf("failover order should follow the first target: %v", first)
+		}
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := newBalancer(config.LeastConnections, []string{"a:1", "b:1", "c:1"})
+
+	b.acquire(0)
+	b.acquire(0)
+	b.acquire(1)
+
+	if got, want := b.order(""), []int{2, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	b.release(0)
+	b.release(0)
+
+	// ties keep the targets order
+	if got, want := b.order(""), []int{0, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBalancerOrderedTargets(t *testing.T) {
+	b := newBalancer(config.RoundRobin, []string{"a:1", "b:1"})
+	b.order("")
+
+	targets, first := b.orderedTargets("")
+	if want := []string{"b:1", "a:1"}; !reflect.DeepEqual(targets, want) || first != 1 {
+		t.Errorf("got %v (first %d), want %v (first 1)", targets, first, want)
+	}
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/mcluseau/kgate/logging"
+)
+
+var (
+	expiryWarning       = 30 * 24 * time.Hour
+	expiryCheckInterval = time.Hour
+
+	certsMutex = sync.Mutex{}
+	certs      = map[string][]*x509.Certificate{}
+)
+
+func RegisterCertificateFlags(flags *pflag.FlagSet) {
+	flags.DurationVar(&expiryWarning, "cert-expiry-warning", expiryWarning, "Warn about certificates expiring within this duration")
+}
+
+// SetCertificates records the certificates in use for a role (server, ca,
+// client...), for expiry warnings and metrics. No certificates removes the
+// role.
+func SetCertificates(role string, crts ...*x509.Certificate) {
+	certsMutex.Lock()
+	defer certsMutex.Unlock()
+
+	if len(crts) == 0 {
+		delete(certs, role)
+		return
+	}
+
+	certs[role] = crts
+
+	for _, crt := range crts {
+		warnExpiry(role, crt)
+	}
+}
+
+// StartExpiryChecks periodically warns about the certificates in use that
+// expire soon.
+func StartExpiryChecks() {
+	go func() {
+		for range time.Tick(expiryCheckInterval) {
+			certsMutex.Lock()
+			for role, crts := range certs {
+				for _, crt := range crts {
+					warnExpiry(role, crt)
+				}
+			}
+			certsMutex.Unlock()
+		}
+	}()
+}
+
+func warnExpiry(role string, crt *x509.Certificate) {
+	left := time.Until(crt.NotAfter)
+
+	switch {
+	case left < 0:
+		logging.Error("certificate expired", "role", role, "subject", crt.Subject.CommonName,
+			"serial", crt.SerialNumber.Text(16), "not-after", crt.NotAfter)
+	case left < expiryWarning:
+		logging.Warn("certificate expires soon", "role", role, "subject", crt.Subject.CommonName,
+			"serial", crt.SerialNumber.Text(16), "not-after", crt.NotAfter, "days-left", int(left.Hours()/24))
+	}
+}
+
+// WriteMetrics writes the expiry of the certificates in use, in the
+// Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	certsMutex.Lock()
+	defer certsMutex.Unlock()
+
+	roles := make([]string, 0, len(certs))
+	for role := range certs {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	fmt.Fprintln(w, "# HELP kgate_certificate_expiry_timestamp_seconds Expiry of the certificates in use.")
+	fmt.Fprintln(w, "# TYPE kgate_certificate_expiry_timestamp_seconds gauge")
+	for _, role := range roles {
+		for _, crt := range certs[role] {
+			fmt.Fprintf(w, "kgate_certificate_expiry_timestamp_seconds{%s} %d\n", certLabels(role, crt), crt.NotAfter.Unix())
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP kgate_certificate_expiring Whether the certificate expires within the warning period.")
+	fmt.Fprintln(w, "# TYPE kgate_certificate_expiring gauge")
+	for _, role := range roles {
+		for _, crt := range certs[role] {
+			expiring := 0
+			if time.Until(crt.NotAfter) < expiryWarning {
+				expiring = 1
+			}
+			fmt.Fprintf(w, "kgate_certificate_expiring{%s} %d\n", certLabels(role, crt), expiring)
+		}
+	}
+}
+
+func certLabels(role string, crt *x509.Certificate) string {
+	return fmt.Sprintf("role=%q,subject=%q,serial=%q", role, crt.Subject.CommonName, crt.SerialNumber.Text(16))
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// ControlMessage is sent by the server on the control stream, when the
+// session opens and whenever its content changes.
+type ControlMessage struct {
+	// Transfers are the local transfers pushed to the client.
+	Transfers []*Listener `json:"transfers"`
+}
+
+// ControlHandler receives the control messages, if set. Control streams are
+// refused otherwise.
+var ControlHandler func(msg *ControlMessage)
+
+// OpenControl opens a control stream on the session.
+func OpenControl(session *yamux.Session) (net.Conn, error) {
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeHeader(stream, &streamHeader{ID: newID(), Control: true}, false); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// WriteControl sends the message on a control stream.
+func WriteControl(w io.Writer, msg *ControlMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+func readControl(session *session, conn net.Conn, header *streamHeader) {
+	log := session.log.With("stream", header.ID)
+
+	if ControlHandler == nil {
+		log.Info("control stream refused")
+		return
+	}
+
+	log.Debug("control stream opened")
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			log.Debug("control stream closed", "error", err)
+			return
+		}
+
+		msg := &ControlMessage{}
+		if err := json.Unmarshal(line, msg); err != nil {
+			log.Error("invalid control message", "error", err)
+			return
+		}
+
+		ControlHandler(msg)
+	}
+}
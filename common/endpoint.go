@@ -0,0 +1,103 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mcluseau/kgate/logging"
+)
+
+const unixPrefix = "unix:"
+
+// splitAddress returns the network and address of a listen spec or target.
+// Addresses like "unix:/path" are unix sockets, anything else is TCP.
+func splitAddress(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	return "tcp", addr
+}
+
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m&^0777 != 0 {
+		return 0, fmt.Errorf("invalid socket mode: %q", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// Listen listens on the given spec. For unix sockets, a stale socket file is
+// removed first and the mode is applied when not empty.
+func Listen(bindSpec, socketMode string) (net.Listener, error) {
+	network, address := splitAddress(bindSpec)
+
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	var mode os.FileMode
+	if socketMode != "" {
+		var err error
+		if mode, err = parseSocketMode(socketMode); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if socketMode != "" {
+		if err := os.Chmod(address, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening on it.
+func removeStaleSocket(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if stat.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, dialTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+
+	if !isConnRefused(err) {
+		return err
+	}
+
+	logging.Info("removing stale socket", "path", path)
+	return os.Remove(path)
+}
+
+func isConnRefused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// HeaderProtocol is the TLS ALPN protocol of peers sending the stream headers
+// as JSON. Older peers don't negotiate it and only read a bare target.
+const HeaderProtocol = "kgate/2"
+
+// streamHeader is the first line written on a stream by the listening side,
+// as JSON, or as the bare target for older peers. A bare target line is also
+// accepted.
+type streamHeader struct {
+	// ID correlates the logs of both sides of the stream.
+	ID string `json:"id,omitempty"`
+
+	// Targets are tried in order, as ordered by the listener's strategy.
+	Targets []string `json:"targets"`
+
+	// Listener is the listen spec that accepted the connection.
+	Listener string `json:"listener,omitempty"`
+
+	// Source and Destination are the addresses of the original client
+	// connection.
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+
+	ProxyProtocol int `json:"proxyProtocol,omitempty"`
+
+	// Control marks the control stream, opened by the server.
+	Control bool `json:"control,omitempty"`
+}
+
+func writeHeader(w io.Writer, h *streamHeader, legacy bool) error {
+	var line []byte
+
+	if legacy {
+		line = []byte(h.Targets[0])
+
+	} else {
+		var err error
+		line, err = json.Marshal(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(append(line, '\n'))
+	return err
+}
+
+func readHeader(r io.Reader) (*streamHeader, error) {
+	buf := &bytes.Buffer{}
+	oneByte := make([]byte, 1)
+	for {
+		_, err := r.Read(oneByte)
+		if err != nil {
+			return nil, err
+		}
+
+		if oneByte[0] == '\n' {
+			break
+		}
+
+		buf.Write(oneByte)
+	}
+
+	line := buf.Bytes()
+
+	if len(line) == 0 || line[0] != '{' {
+		return &streamHeader{Targets: []string{string(line)}}, nil
+	}
+
+	h := &streamHeader{}
+	if err := json.Unmarshal(line, h); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestWriteHeaderLegacy(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h := &streamHeader{ID: "1", Targets: []string{"db1:5432", "db2:5432"}, ProxyProtocol: 2}
+
+	if err := writeHeader(buf, h, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// older peers dial the line as is
+	if got, want := buf.String(), "db1:5432\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for _, h := range []*streamHeader{
+		{Targets: []string{"db:5432"}},
+		{
+			ID:            "abc",
+			Targets:       []string{"db1:5432", "unix:/run/db.sock"},
+			Listener:      ":5432",
+			Source:        "10.0.0.1:1234",
+			Destination:   "10.0.0.2:5432",
+			ProxyProtocol: 1,
+		},
+		{Control: true},
+	} {
+		buf := &bytes.Buffer{}
+		if err := writeHeader(buf, h, false); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("payload")
+
+		got, err := readHeader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, h) {
+			t.Errorf("got %+v, want %+v", got, h)
+		}
+		if rest := buf.String(); rest != "payload" {
+			t.Errorf("header read should stop at the end of line, left %q", rest)
+		}
+	}
+}
+
+func TestReadHeaderBare(t *testing.T) {
+	for _, line := range []string{"db:5432", "unix:/run/db.sock", ""} {
+		h, err := readHeader(bytes.NewBufferString(line + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{line}; !reflect.DeepEqual(h.Targets, want) {
+			t.Errorf("got %v, want %v", h.Targets, want)
+		}
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	for _, data := range []string{"{not json}\n", "db:5432"} {
+		if _, err := readHeader(bytes.NewBufferString(data)); err == nil {
+			t.Errorf("readHeader(%q) should fail", data)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// newID returns a random identifier for sessions and streams.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -1,245 +1,512 @@
 package common
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
 	"github.com/spf13/pflag"
 
+	"github.com/mcluseau/kgate/accesslog"
 	"github.com/mcluseau/kgate/config"
+	"github.com/mcluseau/kgate/logging"
 )
 
 var (
 	dialTimeout  = 10 * time.Second
 	pingInterval = 1 * time.Minute
 
-	remote *yamux.Session
+	// sessions are the live sessions, one per peer, oldest first. The last one
+	// carries the streams of the local transfers.
+	sessions = []*session{}
 
-	remoteMutex = sync.Mutex{}
+	sessionsMutex = sync.Mutex{}
 
-	listenerSpecs []string
-	listeners     []*Listener
+	listenerSpecs       []string
+	listenerStrategy    = config.FirstAvailable
+	sendProxyProtocol   int
+	acceptProxyProtocol bool
+	socketMode          string
 )
 
 type Listener struct {
-	Listen string `json:"listen"`
-	Target string `json:"target"`
+	Listen   string   `json:"listen"`
+	Targets  []string `json:"targets"`
+	Strategy string   `json:"strategy,omitempty"`
+
+	ProxyProtocol       int  `json:"proxyProtocol,omitempty"`
+	AcceptProxyProtocol bool `json:"acceptProxyProtocol,omitempty"`
+
+	SocketMode string `json:"socketMode,omitempty"`
 }
 
 func RegisterFlags(flags *pflag.FlagSet) {
-	flags.StringSliceVarP(&listenerSpecs, "local-transfer", "L", nil, "Local port transfers (syntax: <local addr>:<local port>:<remote addr>:<remote port>")
+	flags.StringSliceVarP(&listenerSpecs, "local-transfer", "L", nil, "Local port transfers (syntax: <local addr>:<local port>:<remote addr>:<remote port>[,<remote addr>:<remote port>...], unix:<path> can replace any <addr>:<port>, ports can be ranges like 5000-5049)")
+	flags.StringVar(&listenerStrategy, "strategy", listenerStrategy, "Strategy for local transfers with multiple targets (first-available, round-robin, least-connections, source-hash)")
+	flags.IntVar(&sendProxyProtocol, "send-proxy-protocol", 0, "PROXY protocol version (1 or 2) to send to local transfers' targets")
+	flags.BoolVar(&acceptProxyProtocol, "accept-proxy-protocol", false, "Expect a PROXY protocol header on local transfers' connections")
+	flags.StringVar(&socketMode, "socket-mode", "", "File mode of local transfers' unix sockets (ie 0660)")
+	accesslog.RegisterFlags(flags)
 }
 
-func parseListeners() {
-	listeners = make([]*Listener, 0)
+// parseListeners returns the listeners defined by the CONFIG env and the
+// flags.
+func parseListeners() []*Listener {
+	listeners := make([]*Listener, 0)
 
 	cfgEnv := os.Getenv("CONFIG")
 
 	if cfgEnv != "" {
 		cfg := &config.Config{}
 		if err := json.Unmarshal([]byte(cfgEnv), cfg); err != nil {
-			log.Fatal("failed to parse CONFIG env: ", err)
+			logging.Fatal("failed to parse CONFIG env", "error", err)
 		}
-
-		for port, tr := range cfg.LocalTransfers {
-			listeners = append(listeners, &Listener{
-				Listen: fmt.Sprintf(":%d", port),
-				Target: tr.Target,
-			})
+		if err := cfg.Validate(); err != nil {
+			logging.Fatal("invalid CONFIG env", "error", err)
 		}
+
+		listeners = append(listeners, ConfigListeners(cfg)...)
 	}
 
+	var last *Listener
 	for _, spec := range listenerSpecs {
 		parts := strings.Split(spec, ":")
 
-		if len(parts) != 4 {
-			log.Fatal("invalid local port transfer spec: ", spec)
+		switch {
+		case len(parts) == 4:
+			last = &Listener{
+				Listen:              parts[0] + ":" + parts[1],
+				Targets:             []string{parts[2] + ":" + parts[3]},
+				Strategy:            listenerStrategy,
+				ProxyProtocol:       sendProxyProtocol,
+				AcceptProxyProtocol: acceptProxyProtocol,
+				SocketMode:          socketMode,
+			}
+			listeners = append(listeners, last)
+
+		case len(parts) == 2 && last != nil:
+			// additional target of the previous spec
+			last.Targets = append(last.Targets, spec)
+
+		default:
+			logging.Fatal("invalid local port transfer spec", "spec", spec)
+		}
+	}
+
+	return listeners
+}
+
+func validateListener(l *Listener) error {
+	if len(l.Targets) == 0 {
+		return errors.New("no target")
+	}
+	if !config.ValidStrategy(l.Strategy) {
+		return fmt.Errorf("invalid strategy: %q", l.Strategy)
+	}
+	if l.ProxyProtocol < 0 || l.ProxyProtocol > 2 {
+		return fmt.Errorf("invalid PROXY protocol version: %d", l.ProxyProtocol)
+	}
+	if l.SocketMode != "" {
+		if _, err := parseSocketMode(l.SocketMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigListeners returns the listeners of the config's transfers.
+func ConfigListeners(cfg *config.Config) []*Listener {
+	listeners := make([]*Listener, 0, len(cfg.LocalTransfers)+len(cfg.Transfers))
+
+	for port, tr := range cfg.LocalTransfers {
+		listeners = append(listeners, transferListener(fmt.Sprintf(":%d", port), tr))
+	}
+
+	for listen, tr := range cfg.Transfers {
+		listeners = append(listeners, transferListener(listen, tr))
+	}
+
+	return listeners
+}
+
+func transferListener(listen string, tr *config.TransferTarget) *Listener {
+	return &Listener{
+		Listen:              listen,
+		Targets:             tr.AllTargets(),
+		Strategy:            tr.Strategy,
+		ProxyProtocol:       tr.ProxyProtocol,
+		AcceptProxyProtocol: tr.AcceptProxyProtocol,
+		SocketMode:          tr.SocketMode,
+	}
+}
+
+// session is a yamux session with its logging context.
+type session struct {
+	rtt int64 // last ping RTT, first for atomic alignment
+
+	*yamux.Session
+	id    string
+	peer  string
+	since time.Time
+	log   *logging.Logger
+
+	// legacy peers didn't negotiate HeaderProtocol
+	legacy bool
+}
+
+func (s *session) setRTT(rtt time.Duration) {
+	atomic.StoreInt64(&s.rtt, int64(rtt))
+}
+
+// currentSession returns the session opened last, if any.
+func currentSession() *session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if len(sessions) == 0 {
+		return nil
+	}
+	return sessions[len(sessions)-1]
+}
+
+// addSession makes the session the current one, replacing the previous
+// session of the same peer. It returns the replaced session, if any.
+func addSession(s *session) (replaced *session) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	kept := make([]*session, 0, len(sessions)+1)
+	for _, other := range sessions {
+		if other.peer == s.peer {
+			replaced = other
+			continue
 		}
+		kept = append(kept, other)
+	}
 
-		listeners = append(listeners, &Listener{
-			Listen: parts[0] + ":" + parts[1],
-			Target: parts[2] + ":" + parts[3],
-		})
+	sessions = append(kept, s)
+	return
+}
+
+func removeSession(s *session) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	for i, other := range sessions {
+		if other == s {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+			return
+		}
 	}
 }
 
-func ManageSession(session *yamux.Session) error {
-	remoteMutex.Lock()
-	prevRemote := remote
-	remote = session
-	remoteMutex.Unlock()
+// ManageSession serves the given session's streams until it is closed. It
+// replaces the previous session of the same peer, and other peers' sessions
+// are kept. peer identifies the other side, and protocol is the ALPN protocol
+// negotiated with it.
+func ManageSession(yamuxSession *yamux.Session, peer, protocol string) error {
+	id := newID()
+	session := &session{
+		Session: yamuxSession,
+		id:      id,
+		peer:    peer,
+		since:   time.Now(),
+		log:     logging.With("session", id, "peer", peer),
+		legacy:  protocol != HeaderProtocol,
+	}
+
+	if session.legacy {
+		session.log.Warn("older peer, streams will only carry their first target")
+	}
 
-	if prevRemote != nil {
-		prevRemote.Close()
+	if replaced := addSession(session); replaced != nil {
+		replaced.log.Info("session replaced by a new one of the same peer", "new_session", id)
+		replaced.Close()
 	}
 
 	if pingRTT, err := session.Ping(); err == nil {
-		log.Print("Session opened (ping: ", pingRTT, ")")
+		session.setRTT(pingRTT)
+		session.log.Info("session opened", "rtt", pingRTT)
 	} else {
-		log.Print("Session ping failed: ", err)
+		session.log.Error("session ping failed", "error", err)
+		removeSession(session)
+		session.Close()
 		return err
 	}
 
 	go func() {
 		for range time.Tick(pingInterval) {
-			if _, err := session.Ping(); err != nil {
-				log.Print("Session ping check failed, closing: ", err)
+			rtt, err := session.Ping()
+			if err != nil {
+				session.log.Warn("session ping check failed, closing", "error", err)
 				session.Close()
 				return
 			}
+			session.setRTT(rtt)
+			session.log.Debug("session ping", "rtt", rtt)
 		}
 	}()
 
 	listenRemote(session)
-	if remote == session {
-		remote = nil
-	}
+	removeSession(session)
 
 	return nil
 }
 
 func StartListeners() {
-	parseListeners()
-
-	for _, listener := range listeners {
-		l := listener
-		go startListener(l.Listen, l.Target)
+	if err := accesslog.Open(); err != nil {
+		logging.Fatal("failed to open access log", "error", err)
 	}
-}
 
-func startListener(bindSpec, target string) {
-	log.Print("Listening on ", bindSpec)
-	l, err := net.Listen("tcp", bindSpec)
-	if err != nil {
-		log.Fatal("Fail to listen: ", err)
-	}
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatal("Accept() failed: ", err)
+	for _, listener := range parseListeners() {
+		if err := AddListener(listener); err != nil {
+			logging.Fatal("failed to start listener", "listener", listener.Listen, "error", err)
 		}
-
-		go handleConn(conn, target)
 	}
 }
 
-func handleConn(conn net.Conn, target string) {
+func handleConn(conn net.Conn, listener *Listener, b *balancer) {
 	defer conn.Close()
 
-	session := remote
+	target := strings.Join(listener.Targets, ",")
+
+	source := conn.RemoteAddr().String()
+	destination := conn.LocalAddr().String()
+
+	rec := &accesslog.Record{
+		Side:     "listen",
+		Stream:   newID(),
+		Listener: listener.Listen,
+		Source:   source,
+		Target:   target,
+		Start:    time.Now(),
+	}
+	defer accesslog.Log(rec)
+
+	session := currentSession()
 	if session == nil {
+		rec.CloseReason = accesslog.NoSession
 		return
 	}
 
-	log.Print("tunneling to ", target)
-	defer log.Print("tunneling to ", target, " finished")
+	rec.Session = session.id
+	rec.Peer = session.peer
+
+	log := session.log.With("stream", rec.Stream, "listener", listener.Listen, "target", target)
+
+	if listener.AcceptProxyProtocol {
+		src, dst, err := readProxyHeader(conn)
+		if err != nil {
+			log.Warn("failed to read PROXY protocol header", "source", source, "error", err)
+			rec.CloseReason = accesslog.ProxyFailed
+			return
+		}
+
+		if src != "" {
+			source, destination = src, dst
+			rec.Source = source
+		}
+	}
+
+	log = log.With("source", source)
+
+	targets, first := b.orderedTargets(source)
+	b.acquire(first)
+	defer b.release(first)
 
 	stream, err := session.Open()
 	if err != nil {
-		log.Print("session open failed: ", err)
+		log.Error("session open failed", "error", err)
+		rec.CloseReason = accesslog.SessionFailed
 		return
 	}
 
 	defer stream.Close()
 
-	stream.Write([]byte(target + "\n"))
+	header := &streamHeader{
+		ID:            rec.Stream,
+		Targets:       targets,
+		Listener:      listener.Listen,
+		Source:        source,
+		Destination:   destination,
+		ProxyProtocol: listener.ProxyProtocol,
+	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	if session.legacy && (len(header.Targets) > 1 || header.ProxyProtocol != 0) {
+		log.Warn("older peer, using the first target without PROXY protocol")
+	}
 
-	go func() {
-		io.Copy(conn, stream)
-		closeWrite(conn)
-		wg.Done()
-	}()
+	if err := writeHeader(stream, header, session.legacy); err != nil {
+		log.Error("failed to write stream header", "error", err)
+		rec.CloseReason = accesslog.HeaderFailed
+		return
+	}
 
-	go func() {
-		io.Copy(stream, conn)
-		stream.Close()
-		wg.Done()
-	}()
+	log.Info("tunneling")
 
-	wg.Wait()
+	active := trackStream(rec, conn, stream)
+	defer untrackStream(active)
+
+	rec.CloseReason = pipe(conn, stream, &active.bytesIn, &active.bytesOut)
+	rec.BytesIn, rec.BytesOut = active.bytes()
+
+	log.Info("tunneling finished", "bytes_in", rec.BytesIn, "bytes_out", rec.BytesOut,
+		"duration", time.Since(rec.Start), "reason", rec.CloseReason)
 }
 
-func listenRemote(session *yamux.Session) {
+func listenRemote(session *session) {
 	for {
 		conn, err := session.Accept()
 		if err != nil {
-			log.Print("session.Accept() failed: ", err)
-			remote = nil
+			session.log.Info("session closed", "error", err)
 			return
 		}
 
-		go handleClientConnection(conn)
+		go handleClientConnection(session, conn)
 	}
 }
 
-func handleClientConnection(conn net.Conn) {
+func handleClientConnection(session *session, conn net.Conn) {
 	defer conn.Close()
 
 	// read the target
-	buf := &bytes.Buffer{}
-	oneByte := make([]byte, 1)
-	for {
-		_, err := conn.Read(oneByte)
-		if err != nil {
-			log.Print("client read error while reading target: ", err)
-			return
-		}
-
-		if oneByte[0] == '\n' {
-			break
-		}
-
-		buf.Write(oneByte)
+	header, err := readHeader(conn)
+	if err != nil {
+		session.log.Error("read error while reading stream header", "error", err)
+		return
 	}
 
-	targetAddr := buf.String()
+	if header.Control {
+		readControl(session, conn, header)
+		return
+	}
 
 	// TODO validate targetAddr allowance
 
 	// proxy
-	proxy(conn, "tcp", targetAddr)
+	proxy(session, conn, header)
 }
 
-func proxy(conn net.Conn, proto, targetAddr string) {
-	log.Print("proxying to ", targetAddr)
-	defer log.Print("proxying to ", targetAddr, " finished")
+func proxy(session *session, conn net.Conn, header *streamHeader) {
+	log := session.log.With("stream", header.ID, "source", header.Source)
+
+	rec := &accesslog.Record{
+		Side:     "dial",
+		Session:  session.id,
+		Peer:     session.peer,
+		Stream:   header.ID,
+		Listener: header.Listener,
+		Source:   header.Source,
+		Target:   strings.Join(header.Targets, ","),
+		Start:    time.Now(),
+	}
+	defer accesslog.Log(rec)
 
-	target, err := net.DialTimeout(proto, targetAddr, dialTimeout)
-	if err != nil {
-		log.Printf("dial %s to %s failed: %v", proto, targetAddr, err)
+	if len(header.Targets) == 0 {
+		log.Error("no target in stream header")
+		rec.CloseReason = accesslog.HeaderFailed
+		return
+	}
+
+	var target net.Conn
+	targetIdx := -1
+
+	for idx, t := range header.Targets {
+		proto, targetAddr := splitAddress(t)
+
+		var err error
+		target, err = net.DialTimeout(proto, targetAddr, dialTimeout)
+		if err != nil {
+			log.Warn("dial failed", "target", t, "error", err)
+			continue
+		}
+
+		targetIdx = idx
+		break
+	}
+
+	if targetIdx == -1 {
+		log.Error("no target available")
+		rec.CloseReason = accesslog.DialFailed
 		return
 	}
 
+	rec.Target = header.Targets[targetIdx]
+	log = log.With("target", rec.Target)
+
 	defer target.Close()
 
+	if header.ProxyProtocol != 0 {
+		if err := writeProxyHeader(target, header.ProxyProtocol, header.Source, header.Destination); err != nil {
+			log.Error("failed to write PROXY protocol header", "error", err)
+			rec.CloseReason = accesslog.ProxyFailed
+			return
+		}
+	}
+
+	log.Info("proxying")
+
+	active := trackStream(rec, conn, target)
+	defer untrackStream(active)
+
+	rec.CloseReason = pipe(conn, target, &active.bytesIn, &active.bytesOut)
+	rec.BytesIn, rec.BytesOut = active.bytes()
+
+	log.Info("proxying finished", "bytes_in", rec.BytesIn, "bytes_out", rec.BytesOut,
+		"duration", time.Since(rec.Start), "reason", rec.CloseReason)
+}
+
+// pipe copies data both ways between the connections until both directions
+// are done, counting the bytes copied from a to b and from b to a. It returns
+// the close reason.
+func pipe(a, b net.Conn, aToB, bToA *int64) (reason string) {
+	var errAToB, errBToA error
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
 	go func() {
-		io.Copy(conn, target)
-		closeWrite(conn)
+		_, errBToA = io.Copy(countingWriter{a, bToA}, b)
+		closeWrite(a)
 		wg.Done()
 	}()
 
 	go func() {
-		io.Copy(target, conn)
-		target.Close()
+		_, errAToB = io.Copy(countingWriter{b, aToB}, a)
+		b.Close()
 		wg.Done()
 	}()
 
 	wg.Wait()
+
+	reason = accesslog.Completed
+	for _, err := range []error{errAToB, errBToA} {
+		if err != nil {
+			reason = err.Error()
+			break
+		}
+	}
+
+	return
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (cw countingWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	atomic.AddInt64(cw.count, int64(n))
+	return
 }
 
 type closeWriter interface {
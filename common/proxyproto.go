@@ -0,0 +1,213 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol, see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+const (
+	proxyV1MaxLen = 107
+
+	proxyV2CmdLocal = 0x20
+	proxyV2CmdProxy = 0x21
+
+	proxyV2TCP4 = 0x11
+	proxyV2TCP6 = 0x21
+)
+
+// writeProxyHeader writes a PROXY protocol header of the given version. When
+// src or dst are not TCP addresses, an UNKNOWN (v1) or LOCAL (v2) header is
+// written.
+func writeProxyHeader(w io.Writer, version int, src, dst string) error {
+	srcAddr, srcErr := net.ResolveTCPAddr("tcp", src)
+	dstAddr, dstErr := net.ResolveTCPAddr("tcp", dst)
+	known := srcErr == nil && dstErr == nil
+
+	if known && (srcAddr.IP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+		// mixed families can't be represented
+		known = false
+	}
+
+	buf := &bytes.Buffer{}
+
+	switch version {
+	case 1:
+		if !known {
+			buf.WriteString("PROXY UNKNOWN\r\n")
+			break
+		}
+
+		proto := "TCP4"
+		if srcAddr.IP.To4() == nil {
+			proto = "TCP6"
+		}
+
+		fmt.Fprintf(buf, "PROXY %s %s %s %d %d\r\n", proto,
+			srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)
+
+	case 2:
+		buf.Write(proxyV2Sig)
+
+		if !known {
+			buf.Write([]byte{proxyV2CmdLocal, 0, 0, 0})
+			break
+		}
+
+		srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4()
+		family := byte(proxyV2TCP4)
+		if srcIP == nil {
+			srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+			family = proxyV2TCP6
+		}
+
+		addrLen := 2*len(srcIP) + 4
+
+		buf.Write([]byte{proxyV2CmdProxy, family})
+		binary.Write(buf, binary.BigEndian, uint16(addrLen))
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		binary.Write(buf, binary.BigEndian, uint16(srcAddr.Port))
+		binary.Write(buf, binary.BigEndian, uint16(dstAddr.Port))
+
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version: %d", version)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header, without consuming
+// anything after it. Empty addresses are returned for UNKNOWN or LOCAL
+// headers.
+func readProxyHeader(r io.Reader) (src, dst string, err error) {
+	first := make([]byte, 1)
+	if _, err = io.ReadFull(r, first); err != nil {
+		return
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		return readProxyV1(r)
+	case proxyV2Sig[0]:
+		return readProxyV2(r)
+	default:
+		err = errInvalidProxyHeader
+		return
+	}
+}
+
+func readProxyV1(r io.Reader) (src, dst string, err error) {
+	line := []byte{proxyV1Prefix[0]}
+	oneByte := make([]byte, 1)
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			err = errInvalidProxyHeader
+			return
+		}
+
+		if _, err = io.ReadFull(r, oneByte); err != nil {
+			return
+		}
+
+		line = append(line, oneByte[0])
+	}
+
+	if !bytes.HasPrefix(line, proxyV1Prefix) {
+		err = errInvalidProxyHeader
+		return
+	}
+
+	fields := strings.Fields(string(line))
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		err = errInvalidProxyHeader
+		return
+	}
+
+	for _, ip := range fields[2:4] {
+		if net.ParseIP(ip) == nil {
+			err = errInvalidProxyHeader
+			return
+		}
+	}
+
+	for _, port := range fields[4:6] {
+		if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+			err = errInvalidProxyHeader
+			return
+		}
+	}
+
+	src = net.JoinHostPort(fields[2], fields[4])
+	dst = net.JoinHostPort(fields[3], fields[5])
+	return
+}
+
+func readProxyV2(r io.Reader) (src, dst string, err error) {
+	hdr := make([]byte, 16)
+	hdr[0] = proxyV2Sig[0]
+
+	if _, err = io.ReadFull(r, hdr[1:]); err != nil {
+		return
+	}
+
+	if !bytes.Equal(hdr[:12], proxyV2Sig) || hdr[12]&0xf0 != 0x20 {
+		err = errInvalidProxyHeader
+		return
+	}
+
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err = io.ReadFull(r, addrs); err != nil {
+		return
+	}
+
+	if hdr[12] == proxyV2CmdLocal {
+		return
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case proxyV2TCP4:
+		ipLen = net.IPv4len
+	case proxyV2TCP6:
+		ipLen = net.IPv6len
+	default:
+		// unsupported family, addresses are ignored
+		return
+	}
+
+	if len(addrs) < 2*ipLen+4 {
+		err = errInvalidProxyHeader
+		return
+	}
+
+	srcIP := net.IP(addrs[:ipLen])
+	dstIP := net.IP(addrs[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(addrs[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(addrs[2*ipLen+2:])
+
+	src = net.JoinHostPort(srcIP.String(), strconv.Itoa(int(srcPort)))
+	dst = net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dstPort)))
+	return
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteProxyHeaderV1(t *testing.T) {
+	for _, tc := range []struct {
+		src, dst string
+		want     string
+	}{
+		{"10.0.0.1:1234", "10.0.0.2:80", "PROXY TCP4 10.0.0.1 10.0.0.2 1234 80\r\n"},
+		{"[2001:db8::1]:1234", "[2001:db8::2]:80", "PROXY TCP6 2001:db8::1 2001:db8::2 1234 80\r\n"},
+		{"10.0.0.1:1234", "[2001:db8::2]:80", "PROXY UNKNOWN\r\n"},
+		{"@", "/run/kgate.sock", "PROXY UNKNOWN\r\n"},
+	} {
+		buf := &bytes.Buffer{}
+		if err := writeProxyHeader(buf, 1, tc.src, tc.dst); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s -> %s: got %q, want %q", tc.src, tc.dst, got, tc.want)
+		}
+	}
+}
+
+func TestWriteProxyHeaderV2(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writeProxyHeader(buf, 2, "10.0.0.1:1234", "10.0.0.2:80"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]byte(nil), proxyV2Sig...)
+	want = append(want, proxyV2CmdProxy, proxyV2TCP4, 0, 12,
+		10, 0, 0, 1, 10, 0, 0, 2, 0x04, 0xd2, 0, 80)
+
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got % x, want % x", buf.Bytes(), want)
+	}
+}
+
+func TestWriteProxyHeaderUnsupported(t *testing.T) {
+	if err := writeProxyHeader(&bytes.Buffer{}, 3, "10.0.0.1:1234", "10.0.0.2:80"); err == nil {
+		t.Error("version 3 should be refused")
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		for _, tc := range []struct {
+			src, dst         string
+			wantSrc, wantDst string
+		}{
+			{"10.0.0.1:1234", "10.0.0.2:80", "10.0.0.1:1234", "10.0.0.2:80"},
+			{"[2001:db8::1]:1234", "[2001:db8::2]:80", "[2001:db8::1]:1234", "[2001:db8::2]:80"},
+			{"@", "/run/kgate.sock", "", ""},
+		} {
+			buf := &bytes.Buffer{}
+			if err := writeProxyHeader(buf, version, tc.src, tc.dst); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("payload")
+
+			src, dst, err := readProxyHeader(buf)
+			if err != nil {
+				t.Errorf("v%d %s -> %s: %v", version, tc.src, tc.dst, err)
+				continue
+			}
+			if src != tc.wantSrc || dst != tc.wantDst {
+				t.Errorf("v%d: got %s -> %s, want %s -> %s", version, src, dst, tc.wantSrc, tc.wantDst)
+			}
+			if rest := buf.String(); rest != "payload" {
+				t.Errorf("v%d: the header read should stop at its end, left %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	for _, data := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 10.0.0.1 10.0.0.2 1234\r\n",
+		"PROXY TCP4 10.0.0.1 not-an-ip 1234 80\r\n",
+		"PROXY TCP4 10.0.0.1 10.0.0.2 1234 99999\r\n",
+		"PROXY UDP4 10.0.0.1 10.0.0.2 1234 80\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n",
+		"PROXY TCP4",
+		string(proxyV2Sig[:8]),
+		string(proxyV2Sig) + "\x11\x11\x00\x0c",
+		string(proxyV2Sig) + "\x21\x11\x00\x04\x0a\x00\x00\x01",
+	} {
+		if _, _, err := readProxyHeader(bytes.NewBufferString(data)); err == nil {
+			t.Errorf("readProxyHeader(%q) should fail", data)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mcluseau/kgate/config"
+)
+
+// ExpandRanges expands a listener on a port range into one listener per port.
+// Targets must be ranges of the same size, or single ports.
+func ExpandRanges(l *Listener) ([]*Listener, error) {
+	if err := config.ValidateRanges(l.Listen, l.Targets); err != nil {
+		return nil, err
+	}
+
+	network, address := splitAddress(l.Listen)
+	if network != "tcp" {
+		return []*Listener{l}, nil
+	}
+
+	host, ports, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(ports, "-") {
+		return []*Listener{l}, nil
+	}
+
+	first, last, err := config.ParsePortRange(ports)
+	if err != nil {
+		return nil, err
+	}
+
+	type targetRange struct {
+		host        string
+		first, last int
+	}
+
+	targets := make([]targetRange, len(l.Targets))
+	for idx, target := range l.Targets {
+		_, address := splitAddress(target)
+
+		tHost, tPorts, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		tFirst, tLast, err := config.ParsePortRange(tPorts)
+		if err != nil {
+			return nil, err
+		}
+
+		targets[idx] = targetRange{tHost, tFirst, tLast}
+	}
+
+	listeners := make([]*Listener, 0, last-first+1)
+	for offset := 0; offset <= last-first; offset++ {
+		expanded := *l
+		expanded.Listen = net.JoinHostPort(host, strconv.Itoa(first+offset))
+		expanded.Targets = make([]string, len(targets))
+
+		for idx, t := range targets {
+			port := t.first
+			if t.first != t.last {
+				port += offset
+			}
+			expanded.Targets[idx] = net.JoinHostPort(t.host, strconv.Itoa(port))
+		}
+
+		listeners = append(listeners, &expanded)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandRanges(t *testing.T) {
+	for _, tc := range []struct {
+		listen  string
+		targets []string
+		want    map[string][]string
+	}{
+		{
+			listen:  "127.0.0.1:5432",
+			targets: []string{"db1:5432", "db2:5432"},
+			want:    map[string][]string{"127.0.0.1:5432": {"db1:5432", "db2:5432"}},
+		},
+		{
+			listen:  ":5000-5002",
+			targets: []string{"a:6000-6002", "b:7000"},
+			want: map[string][]string{
+				":5000": {"a:6000", "b:7000"},
+				":5001": {"a:6001", "b:7000"},
+				":5002": {"a:6002", "b:7000"},
+			},
+		},
+		{
+			listen:  "unix:/run/kgate.sock",
+			targets: []string{"unix:/run/db.sock"},
+			want:    map[string][]string{"unix:/run/kgate.sock": {"unix:/run/db.sock"}},
+		},
+	} {
+		expanded, err := ExpandRanges(&Listener{Listen: tc.listen, Targets: tc.targets, Strategy: "round-robin"})
+		if err != nil {
+			t.Errorf("%s: %v", tc.listen, err)
+			continue
+		}
+
+		got := map[string][]string{}
+		for _, l := range expanded {
+			if l.Strategy != "round-robin" {
+				t.Errorf("%s: strategy not kept on %s", tc.listen, l.Listen)
+			}
+			got[l.Listen] = l.Targets
+		}
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.listen, got, tc.want)
+		}
+	}
+}
+
+func TestExpandRangesInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		listen  string
+		targets []string
+	}{
+		{":5000-5049", []string{"host:5000-5048"}}, // mismatched lengths
+		{":5049-5000", []string{"host:5000"}},      // reversed bounds
+		{":5000-5049", []string{"host:5049-5000"}},
+		{":5000", []string{"host:5000-5049"}}, // target range on a single port
+		{":5000-5049", []string{"unix:/run/db.sock"}},
+		{":0-10", []string{"host:1"}},
+		{":5000-70000", []string{"host:1"}},
+		{"5000", []string{"host:1"}},
+		{":5000", []string{"host"}},
+	} {
+		if _, err := ExpandRanges(&Listener{Listen: tc.listen, Targets: tc.targets}); err == nil {
+			t.Errorf("%s -> %v should fail", tc.listen, tc.targets)
+		}
+	}
+}
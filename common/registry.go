@@ -0,0 +1,287 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcluseau/kgate/accesslog"
+	"github.com/mcluseau/kgate/logging"
+)
+
+var (
+	running      = map[string]*runningListener{}
+	runningMutex = sync.Mutex{}
+
+	streams      = map[string]*activeStream{}
+	streamsMutex = sync.Mutex{}
+)
+
+type runningListener struct {
+	*Listener
+
+	// origin is the listen spec before port range expansion.
+	origin string
+
+	l net.Listener
+
+	// balancer orders the targets of the listener's connections.
+	balancer *balancer
+}
+
+// Listeners returns the running listeners.
+func Listeners() []*Listener {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+
+	ls := make([]*Listener, 0, len(running))
+	for _, rl := range running {
+		ls = append(ls, rl.Listener)
+	}
+
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Listen < ls[j].Listen })
+	return ls
+}
+
+// AddListener starts the listener, or one listener per port for a port range.
+func AddListener(listener *Listener) error {
+	if err := validateListener(listener); err != nil {
+		return err
+	}
+
+	expanded, err := ExpandRanges(listener)
+	if err != nil {
+		return err
+	}
+
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+
+	for _, l := range expanded {
+		if _, exists := running[l.Listen]; exists {
+			return fmt.Errorf("already listening on %s", l.Listen)
+		}
+	}
+
+	started := make([]*runningListener, 0, len(expanded))
+	for _, l := range expanded {
+		netListener, err := Listen(l.Listen, l.SocketMode)
+		if err != nil {
+			for _, rl := range started {
+				rl.l.Close()
+				delete(running, rl.Listen)
+			}
+			return err
+		}
+
+		rl := &runningListener{
+			Listener: l,
+			origin:   listener.Listen,
+			l:        netListener,
+			balancer: newBalancer(l.Strategy, l.Targets),
+		}
+
+		running[l.Listen] = rl
+		started = append(started, rl)
+	}
+
+	for _, rl := range started {
+		logging.Info("listening", "listener", rl.Listen)
+		go serveListener(rl)
+	}
+
+	return nil
+}
+
+// RemoveListener stops the listener(s) added with the given listen spec.
+// Active streams are not interrupted.
+func RemoveListener(listen string) error {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+
+	found := false
+	for key, rl := range running {
+		if rl.Listen != listen && rl.origin != listen {
+			continue
+		}
+
+		found = true
+		delete(running, key)
+		rl.l.Close()
+		logging.Info("listener removed", "listener", rl.Listen)
+	}
+
+	if !found {
+		return fmt.Errorf("no listener on %s", listen)
+	}
+
+	return nil
+}
+
+func serveListener(rl *runningListener) {
+	for {
+		conn, err := rl.l.Accept()
+		if err != nil {
+			runningMutex.Lock()
+			removed := running[rl.Listen] != rl
+			runningMutex.Unlock()
+
+			if removed {
+				return
+			}
+
+			logging.Fatal("accept failed", "listener", rl.Listen, "error", err)
+		}
+
+		go handleConn(conn, rl.Listener, rl.balancer)
+	}
+}
+
+// SessionInfo describes the current session.
+type SessionInfo struct {
+	Connected bool       `json:"connected"`
+	ID        string     `json:"id,omitempty"`
+	Peer      string     `json:"peer,omitempty"`
+	Since     *time.Time `json:"since,omitempty"`
+	RTT       string     `json:"rtt,omitempty"`
+}
+
+// Session returns information about the current session.
+func Session() SessionInfo {
+	s := currentSession()
+	if s == nil {
+		return SessionInfo{}
+	}
+
+	return s.info()
+}
+
+// Sessions returns information about the live sessions, one per peer,
+// oldest first.
+func Sessions() []SessionInfo {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+func (s *session) info() SessionInfo {
+	since := s.since
+	return SessionInfo{
+		Connected: true,
+		ID:        s.id,
+		Peer:      s.peer,
+		Since:     &since,
+		RTT:       time.Duration(atomic.LoadInt64(&s.rtt)).String(),
+	}
+}
+
+// CloseSession closes the current session, if any. The client will then
+// reconnect.
+func CloseSession() bool {
+	s := currentSession()
+	if s == nil {
+		return false
+	}
+
+	s.log.Info("closing session on request")
+	s.Close()
+	return true
+}
+
+type activeStream struct {
+	// counters first for atomic alignment
+	bytesIn, bytesOut int64
+
+	rec     *accesslog.Record
+	closers []io.Closer
+}
+
+func (s *activeStream) bytes() (in, out int64) {
+	return atomic.LoadInt64(&s.bytesIn), atomic.LoadInt64(&s.bytesOut)
+}
+
+func trackStream(rec *accesslog.Record, closers ...io.Closer) *activeStream {
+	s := &activeStream{
+		rec:     rec,
+		closers: closers,
+	}
+
+	streamsMutex.Lock()
+	streams[rec.Stream] = s
+	streamsMutex.Unlock()
+
+	return s
+}
+
+func untrackStream(s *activeStream) {
+	streamsMutex.Lock()
+	if streams[s.rec.Stream] == s {
+		delete(streams, s.rec.Stream)
+	}
+	streamsMutex.Unlock()
+}
+
+// StreamInfo describes an active stream.
+type StreamInfo struct {
+	ID       string    `json:"id"`
+	Side     string    `json:"side"`
+	Listener string    `json:"listener,omitempty"`
+	Source   string    `json:"source"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	Age      string    `json:"age"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+}
+
+// Streams returns the active streams, oldest first.
+func Streams() []StreamInfo {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+
+	now := time.Now()
+
+	infos := make([]StreamInfo, 0, len(streams))
+	for _, s := range streams {
+		in, out := s.bytes()
+		infos = append(infos, StreamInfo{
+			ID:       s.rec.Stream,
+			Side:     s.rec.Side,
+			Listener: s.rec.Listener,
+			Source:   s.rec.Source,
+			Target:   s.rec.Target,
+			Start:    s.rec.Start,
+			Age:      now.Sub(s.rec.Start).Truncate(time.Second).String(),
+			BytesIn:  in,
+			BytesOut: out,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos
+}
+
+// KillStream closes the stream with the given ID.
+func KillStream(id string) bool {
+	streamsMutex.Lock()
+	s, ok := streams[id]
+	streamsMutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	for _, c := range s.closers {
+		c.Close()
+	}
+	return true
+}
@@ -1,9 +1,200 @@
 package config
 
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Load balancing strategies for transfers with multiple targets.
+const (
+	FirstAvailable   = "first-available"
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+	SourceHash       = "source-hash"
+)
+
 type Config struct {
 	LocalTransfers map[int]*TransferTarget
+
+	// Transfers are keyed by listen spec, like "127.0.0.1:80",
+	// "unix:/path/to/socket" or ":5000-5049" for a port range (the targets
+	// then being ranges of the same size, like "host:5000-5049").
+	Transfers map[string]*TransferTarget `json:",omitempty"`
 }
 
 type TransferTarget struct {
-	Target string
+	Target string `json:",omitempty"`
+
+	// Targets are backends tried in the order given by Strategy, the next one
+	// being used when a dial fails.
+	Targets  []string `json:",omitempty"`
+	Strategy string   `json:",omitempty"`
+
+	// ProxyProtocol is the PROXY protocol version (1 or 2) to send to the
+	// target, 0 to disable.
+	ProxyProtocol int `json:",omitempty"`
+
+	// AcceptProxyProtocol makes the listener expect a PROXY protocol header
+	// (v1 or v2) from an upstream load balancer.
+	AcceptProxyProtocol bool `json:",omitempty"`
+
+	// SocketMode is the octal file mode of unix socket listeners (ie "0660").
+	SocketMode string `json:",omitempty"`
+}
+
+// AllTargets returns Target followed by Targets.
+func (t *TransferTarget) AllTargets() []string {
+	targets := make([]string, 0, 1+len(t.Targets))
+	if t.Target != "" {
+		targets = append(targets, t.Target)
+	}
+	return append(targets, t.Targets...)
+}
+
+// ValidStrategy checks that the strategy is known. The empty string is valid
+// and means FirstAvailable.
+func ValidStrategy(strategy string) bool {
+	switch strategy {
+	case "", FirstAvailable, RoundRobin, LeastConnections, SourceHash:
+		return true
+	}
+	return false
+}
+
+// ParsePortRange parses a port ("80") or a port range ("5000-5049").
+func ParsePortRange(s string) (first, last int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+
+	if first, err = parsePort(parts[0]); err != nil {
+		return
+	}
+
+	if len(parts) == 1 {
+		last = first
+		return
+	}
+
+	if last, err = parsePort(parts[1]); err != nil {
+		return
+	}
+
+	if last < first {
+		err = fmt.Errorf("invalid port range: %q", s)
+	}
+	return
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port: %q", s)
+	}
+	return int(port), nil
+}
+
+// ValidateRanges checks the targets of a transfer listening on listen. On a
+// port range, targets must be ranges of the same size or single ports,
+// otherwise they must be single ports.
+func ValidateRanges(listen string, targets []string) error {
+	size := 0
+
+	if !strings.HasPrefix(listen, "unix:") {
+		idx := strings.LastIndex(listen, ":")
+		if idx == -1 {
+			return fmt.Errorf("invalid listen spec: %q", listen)
+		}
+
+		first, last, err := ParsePortRange(listen[idx+1:])
+		if err != nil {
+			return err
+		}
+		size = last - first
+	}
+
+	for _, target := range targets {
+		if strings.HasPrefix(target, "unix:") {
+			if size != 0 {
+				return fmt.Errorf("target %s can't be used with a port range", target)
+			}
+			continue
+		}
+
+		idx := strings.LastIndex(target, ":")
+		if idx == -1 {
+			return fmt.Errorf("invalid target: %q", target)
+		}
+
+		first, last, err := ParsePortRange(target[idx+1:])
+		if err != nil {
+			return err
+		}
+
+		if first != last && last-first != size {
+			if size == 0 {
+				return fmt.Errorf("target range %s needs a listen range", target)
+			}
+			return fmt.Errorf("target range %s doesn't match listen range %s", target, listen)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the port ranges of the transfers, and that no port is
+// listened on twice, a listener without host overlapping any host.
+func (c *Config) Validate() error {
+	type portSpan struct {
+		listen      string
+		host        string
+		first, last int
+	}
+
+	spans := make([]portSpan, 0, len(c.LocalTransfers)+len(c.Transfers))
+
+	for port, tr := range c.LocalTransfers {
+		listen := ":" + strconv.Itoa(port)
+		if err := ValidateRanges(listen, tr.AllTargets()); err != nil {
+			return fmt.Errorf("%s: %v", listen, err)
+		}
+		spans = append(spans, portSpan{listen, "", port, port})
+	}
+
+	for listen, tr := range c.Transfers {
+		if err := ValidateRanges(listen, tr.AllTargets()); err != nil {
+			return fmt.Errorf("%s: %v", listen, err)
+		}
+
+		if strings.HasPrefix(listen, "unix:") {
+			continue
+		}
+
+		idx := strings.LastIndex(listen, ":")
+		first, last, _ := ParsePortRange(listen[idx+1:]) // checked above
+		spans = append(spans, portSpan{listen, listen[:idx], first, last})
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].listen < spans[j].listen })
+
+	for i, a := range spans {
+		for _, b := range spans[i+1:] {
+			if a.first > b.last || b.first > a.last {
+				continue
+			}
+			if a.host == b.host || anyHost(a.host) || anyHost(b.host) {
+				return fmt.Errorf("%s overlaps %s", a.listen, b.listen)
+			}
+		}
+	}
+
+	return nil
+}
+
+func anyHost(host string) bool {
+	switch host {
+	case "", "0.0.0.0", "[::]":
+		return true
+	}
+	return false
 }
@@ -0,0 +1,70 @@
+package config
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	for _, tc := range []struct {
+		s           string
+		first, last int
+		ok          bool
+	}{
+		{"80", 80, 80, true},
+		{"5000-5049", 5000, 5049, true},
+		{"5000-5000", 5000, 5000, true},
+		{"5049-5000", 0, 0, false},
+		{"0", 0, 0, false},
+		{"65536", 0, 0, false},
+		{"a-b", 0, 0, false},
+		{"", 0, 0, false},
+	} {
+		first, last, err := ParsePortRange(tc.s)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%q: got error %v", tc.s, err)
+			continue
+		}
+		if tc.ok && (first != tc.first || last != tc.last) {
+			t.Errorf("%q: got %d-%d, want %d-%d", tc.s, first, last, tc.first, tc.last)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	target := func(t string) *TransferTarget { return &TransferTarget{Target: t} }
+
+	for _, tc := range []struct {
+		name string
+		cfg  *Config
+		ok   bool
+	}{
+		{"distinct ports", &Config{
+			LocalTransfers: map[int]*TransferTarget{5432: target("db:5432")},
+			Transfers:      map[string]*TransferTarget{":5000-5049": target("h:5000-5049")},
+		}, true},
+		{"distinct hosts", &Config{
+			Transfers: map[string]*TransferTarget{
+				"127.0.0.1:5000": target("a:1"),
+				"127.0.0.2:5000": target("b:1"),
+			},
+		}, true},
+		{"unix sockets", &Config{
+			Transfers: map[string]*TransferTarget{"unix:/run/a.sock": target("a:1")},
+		}, true},
+		{"port in range", &Config{
+			LocalTransfers: map[int]*TransferTarget{5010: target("db:5432")},
+			Transfers:      map[string]*TransferTarget{":5000-5049": target("h:5000-5049")},
+		}, false},
+		{"overlapping ranges", &Config{
+			Transfers: map[string]*TransferTarget{
+				":5000-5049":          target("h:5000-5049"),
+				"127.0.0.1:5049-5060": target("h:1"),
+			},
+		}, false},
+		{"invalid range", &Config{
+			Transfers: map[string]*TransferTarget{":5000-5049": target("h:5000-5010")},
+		}, false},
+	} {
+		if err := tc.cfg.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package logging provides a leveled logger with structured fields.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// Output formats.
+const (
+	Text   = "text"
+	Logfmt = "logfmt"
+	JSON   = "json"
+)
+
+var (
+	level  = InfoLevel
+	format = Text
+
+	out      io.Writer = os.Stderr
+	outMutex           = sync.Mutex{}
+
+	root = &Logger{}
+)
+
+func RegisterFlags(flags *pflag.FlagSet) {
+	flags.Var((*levelValue)(&level), "log-level", "Log level (debug, info, warn, error)")
+	flags.Var((*formatValue)(&format), "log-format", "Log format (text, logfmt, json)")
+}
+
+// SetOutput sets the destination of all loggers.
+func SetOutput(w io.Writer) {
+	outMutex.Lock()
+	out = w
+	outMutex.Unlock()
+}
+
+// Logger writes messages with a set of key/value fields.
+type Logger struct {
+	fields []interface{}
+}
+
+// With returns a logger adding the given key/value pairs to every message.
+func With(kv ...interface{}) *Logger {
+	return root.With(kv...)
+}
+
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+func Debug(msg string, kv ...interface{}) { root.log(DebugLevel, msg, kv) }
+func Info(msg string, kv ...interface{})  { root.log(InfoLevel, msg, kv) }
+func Warn(msg string, kv ...interface{})  { root.log(WarnLevel, msg, kv) }
+func Error(msg string, kv ...interface{}) { root.log(ErrorLevel, msg, kv) }
+func Fatal(msg string, kv ...interface{}) { root.Fatal(msg, kv...) }
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(DebugLevel, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(InfoLevel, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(WarnLevel, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(ErrorLevel, msg, kv) }
+
+// Fatal logs at error level and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(ErrorLevel, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(lvl Level, msg string, kv []interface{}) {
+	if lvl < level {
+		return
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	now := time.Now()
+	buf := &bytes.Buffer{}
+
+	switch format {
+	case JSON:
+		writeJSON(buf, now, lvl, msg, fields)
+	case Logfmt:
+		writeLogfmt(buf, now, lvl, msg, fields)
+	default:
+		writeText(buf, now, lvl, msg, fields)
+	}
+
+	buf.WriteByte('\n')
+
+	outMutex.Lock()
+	out.Write(buf.Bytes())
+	outMutex.Unlock()
+}
+
+func writeText(buf *bytes.Buffer, now time.Time, lvl Level, msg string, fields []interface{}) {
+	buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+	buf.WriteString(strings.ToUpper(lvl.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(' ')
+		writeLogfmtPair(buf, fields[i], fields[i+1])
+	}
+}
+
+func writeLogfmt(buf *bytes.Buffer, now time.Time, lvl Level, msg string, fields []interface{}) {
+	writeLogfmtPair(buf, "time", now.Format(time.RFC3339Nano))
+	buf.WriteByte(' ')
+	writeLogfmtPair(buf, "level", lvl.String())
+	buf.WriteByte(' ')
+	writeLogfmtPair(buf, "msg", msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(' ')
+		writeLogfmtPair(buf, fields[i], fields[i+1])
+	}
+}
+
+func writeLogfmtPair(buf *bytes.Buffer, key, value interface{}) {
+	buf.WriteString(fmt.Sprint(key))
+	buf.WriteByte('=')
+
+	s := valueString(value)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		s = strconv.Quote(s)
+	}
+	buf.WriteString(s)
+}
+
+func writeJSON(buf *bytes.Buffer, now time.Time, lvl Level, msg string, fields []interface{}) {
+	// keep fields in order, so a map can't be used
+	buf.WriteByte('{')
+	writeJSONPair(buf, "time", now.Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeJSONPair(buf, "level", lvl.String())
+	buf.WriteByte(',')
+	writeJSONPair(buf, "msg", msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(',')
+
+		value := fields[i+1]
+		switch v := value.(type) {
+		case error, fmt.Stringer, time.Duration:
+			value = valueString(v)
+		}
+
+		writeJSONPair(buf, fmt.Sprint(fields[i]), value)
+	}
+	buf.WriteByte('}')
+}
+
+func writeJSONPair(buf *bytes.Buffer, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(v)
+}
+
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type levelValue Level
+
+func (v *levelValue) String() string { return Level(*v).String() }
+func (v *levelValue) Type() string   { return "level" }
+
+func (v *levelValue) Set(s string) error {
+	for idx, name := range levelNames {
+		if name == s {
+			*v = levelValue(idx)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level: %q", s)
+}
+
+type formatValue string
+
+func (v *formatValue) String() string { return string(*v) }
+func (v *formatValue) Type() string   { return "format" }
+
+func (v *formatValue) Set(s string) error {
+	switch s {
+	case Text, Logfmt, JSON:
+		*v = formatValue(s)
+		return nil
+	}
+	return fmt.Errorf("unknown log format: %q", s)
+}
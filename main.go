@@ -6,11 +6,14 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/mcluseau/kgate/client"
+	"github.com/mcluseau/kgate/logging"
 	"github.com/mcluseau/kgate/server"
 )
 
 func main() {
 	cmd := &cobra.Command{}
+	logging.RegisterFlags(cmd.PersistentFlags())
+
 	cmd.AddCommand(
 		server.Command(),
 		client.Command())
@@ -0,0 +1,114 @@
+// Package passphrase reads the passphrase of encrypted client bundles.
+package passphrase
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// EnvVar holds the passphrase.
+	EnvVar = "KGATE_PASSPHRASE"
+
+	// AgentEnvVar holds the path of the agent socket.
+	AgentEnvVar = "KGATE_PASSPHRASE_AGENT"
+
+	agentTimeout = 10 * time.Second
+)
+
+// Source tells where to read a passphrase from. The first set of File,
+// Agent and the EnvVar env is used, the terminal is prompted otherwise.
+type Source struct {
+	// File contains the passphrase (a trailing newline is ignored).
+	File string
+
+	// Agent is the unix socket of a passphrase agent. The agent is sent the
+	// passphrase ID on a line and replies with the passphrase on a line.
+	Agent string
+}
+
+// Read returns the passphrase of id. When prompting, confirm asks for it
+// twice.
+func (s Source) Read(id string, confirm bool) ([]byte, error) {
+	switch {
+	case s.File != "":
+		data, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return nil, err
+		}
+		return nonEmpty(bytes.TrimRight(data, "\r\n"))
+
+	case s.Agent != "":
+		return askAgent(s.Agent, id)
+
+	case os.Getenv(EnvVar) != "":
+		return []byte(os.Getenv(EnvVar)), nil
+	}
+
+	return prompt(id, confirm)
+}
+
+func askAgent(socket, id string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", socket, agentTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("passphrase agent: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(agentTimeout))
+
+	if _, err := fmt.Fprintln(conn, id); err != nil {
+		return nil, fmt.Errorf("passphrase agent: %v", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, fmt.Errorf("passphrase agent: no reply: %v", err)
+	}
+
+	return nonEmpty(bytes.TrimRight(line, "\r\n"))
+}
+
+func prompt(id string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, fmt.Errorf("no passphrase given (file, agent or %s env) and no terminal to prompt", EnvVar)
+	}
+
+	fmt.Fprintf(os.Stderr, "Passphrase for %s: ", id)
+	pass, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(pass, again) {
+			return nil, errors.New("passphrases don't match")
+		}
+	}
+
+	return nonEmpty(pass)
+}
+
+func nonEmpty(pass []byte) ([]byte, error) {
+	if len(pass) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return pass, nil
+}
@@ -0,0 +1,125 @@
+package pki
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// EncryptedKeyBlockType is the PEM block type of passphrase-encrypted keys.
+const EncryptedKeyBlockType = "KGATE ENCRYPTED PRIVATE KEY"
+
+// scrypt parameters of newly encrypted keys
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	keyLen  = 32
+	saltLen = 16
+)
+
+// EncryptKey encrypts the PEM key with the passphrase (scrypt then
+// AES-256-GCM). The parameters are kept in the PEM headers.
+func EncryptKey(keyPEM, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := keyCipher(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: EncryptedKeyBlockType,
+		Headers: map[string]string{
+			"KDF":    "scrypt",
+			"N":      strconv.Itoa(scryptN),
+			"R":      strconv.Itoa(scryptR),
+			"P":      strconv.Itoa(scryptP),
+			"Salt":   hex.EncodeToString(salt),
+			"Cipher": "aes-256-gcm",
+			"Nonce":  hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, keyPEM, nil),
+	}), nil
+}
+
+// DecryptKey returns the PEM key encrypted by EncryptKey.
+func DecryptKey(data, passphrase []byte) ([]byte, error) {
+	p, _ := pem.Decode(data)
+	if p == nil {
+		return nil, errors.New("no PEM data in encrypted key")
+	}
+	if p.Type != EncryptedKeyBlockType {
+		return nil, fmt.Errorf("wrong encrypted key type: %s", p.Type)
+	}
+
+	h := p.Headers
+	if h["KDF"] != "scrypt" || h["Cipher"] != "aes-256-gcm" {
+		return nil, fmt.Errorf("unsupported key encryption: %s/%s", h["KDF"], h["Cipher"])
+	}
+
+	params := make([]int, 3)
+	for i, name := range []string{"N", "R", "P"} {
+		v, err := strconv.Atoi(h[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid scrypt parameter %s: %v", name, err)
+		}
+		params[i] = v
+	}
+
+	salt, err := hex.DecodeString(h["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	nonce, err := hex.DecodeString(h["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %v", err)
+	}
+
+	aead, err := keyCipher(passphrase, salt, params[0], params[1], params[2])
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+
+	keyPEM, err := aead.Open(nil, nonce, p.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	return keyPEM, nil
+}
+
+func keyCipher(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, keyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
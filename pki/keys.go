@@ -0,0 +1,140 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// KeyAlgorithm is the algorithm of generated private keys.
+type KeyAlgorithm string
+
+const (
+	ECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	ECDSAP384 KeyAlgorithm = "ecdsa-p384"
+	Ed25519   KeyAlgorithm = "ed25519"
+	RSA2048   KeyAlgorithm = "rsa-2048"
+	RSA4096   KeyAlgorithm = "rsa-4096"
+
+	DefaultKeyAlgorithm = ECDSAP256
+)
+
+// PEM block types.
+const (
+	ECPrivateKeyBlockType    = "EC PRIVATE KEY"
+	RSAPrivateKeyBlockType   = "RSA PRIVATE KEY"
+	PKCS8PrivateKeyBlockType = "PRIVATE KEY"
+	CertificateBlockType     = "CERTIFICATE"
+	CSRBlockType             = "CERTIFICATE REQUEST"
+)
+
+// KeyAlgorithms lists the supported key algorithms.
+var KeyAlgorithms = []KeyAlgorithm{ECDSAP256, ECDSAP384, Ed25519, RSA2048, RSA4096}
+
+// ParseKeyAlgorithm returns the named key algorithm.
+func ParseKeyAlgorithm(name string) (KeyAlgorithm, error) {
+	for _, alg := range KeyAlgorithms {
+		if string(alg) == name {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("unknown key algorithm %q (supported: %v)", name, KeyAlgorithms)
+}
+
+// GenerateKey returns a new private key and its PEM encoding.
+func GenerateKey(alg KeyAlgorithm) (crypto.Signer, []byte, error) {
+	var (
+		key crypto.Signer
+		err error
+	)
+
+	switch alg {
+	case ECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case RSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case RSA4096:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, nil, fmt.Errorf("unknown key algorithm %q", alg)
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate the key: %v", err)
+	}
+
+	keyPEM, err := EncodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, keyPEM, nil
+}
+
+// EncodePrivateKey encodes the key to PEM, as SEC 1 for EC keys, PKCS #1 for
+// RSA keys and PKCS #8 otherwise.
+func EncodePrivateKey(key crypto.Signer) ([]byte, error) {
+	var block *pem.Block
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal EC key: %v", err)
+		}
+		block = &pem.Block{Type: ECPrivateKeyBlockType, Bytes: b}
+
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: RSAPrivateKeyBlockType, Bytes: x509.MarshalPKCS1PrivateKey(k)}
+
+	default:
+		b, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal key: %v", err)
+		}
+		block = &pem.Block{Type: PKCS8PrivateKeyBlockType, Bytes: b}
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+// ParsePrivateKey parses the first private key of the PEM data.
+func ParsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	p, _ := pem.Decode(keyPEM)
+	if p == nil {
+		return nil, errors.New("no PEM data in key")
+	}
+
+	switch p.Type {
+	case ECPrivateKeyBlockType:
+		return x509.ParseECPrivateKey(p.Bytes)
+
+	case RSAPrivateKeyBlockType:
+		return x509.ParsePKCS1PrivateKey(p.Bytes)
+
+	case PKCS8PrivateKeyBlockType:
+		key, err := x509.ParsePKCS8PrivateKey(p.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+
+	default:
+		return nil, fmt.Errorf("wrong key type: %s", p.Type)
+	}
+}
@@ -0,0 +1,303 @@
+// Package pki issues the keys and certificates of kgate servers and clients.
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultCAValidity = 5 * 365 * 24 * time.Hour
+	DefaultValidity   = 365 * 24 * time.Hour
+
+	serialBits = 128
+)
+
+// Options describe a certificate to issue.
+type Options struct {
+	CommonName string
+
+	// SANs are DNS names, IP addresses or URIs (anything with a scheme).
+	SANs []string
+
+	// Validity defaults to DefaultValidity, or DefaultCAValidity for a CA.
+	Validity time.Duration
+
+	// ExtKeyUsages default to client and server authentication.
+	ExtKeyUsages []x509.ExtKeyUsage
+}
+
+// CA is a certificate authority issuing certificates.
+type CA struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// NewCA returns the PEM certificate of a new self-signed CA.
+func NewCA(key crypto.Signer, opts Options) ([]byte, error) {
+	validity := opts.Validity
+	if validity == 0 {
+		validity = DefaultCAValidity
+	}
+
+	serial, err := NewSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	skid, err := subjectKeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		Subject:               pkix.Name{CommonName: opts.CommonName},
+		SubjectKeyId:          skid,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the CA certificate: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: CertificateBlockType, Bytes: der}), nil
+}
+
+// LoadCA loads a CA from its PEM certificate and key. Only the first
+// certificate is used, so the certificate may be a bundle.
+func LoadCA(crtPEM, keyPEM []byte) (*CA, error) {
+	crt, err := ParseCertificate(crtPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if !crt.IsCA {
+		return nil, errors.New("not a CA certificate")
+	}
+
+	key, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{Certificate: crt, Key: key}, nil
+}
+
+// Issue returns a PEM certificate for the public key, signed by the CA. The
+// certificate doesn't outlive the CA.
+func (ca *CA) Issue(pub crypto.PublicKey, opts Options) ([]byte, error) {
+	validity := opts.Validity
+	if validity == 0 {
+		validity = DefaultValidity
+	}
+
+	usages := opts.ExtKeyUsages
+	if len(usages) == 0 {
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+	}
+
+	dnsNames, ips, uris, err := SplitSANs(opts.SANs)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := NewSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := time.Now()
+	notAfter := notBefore.Add(validity)
+	if notAfter.After(ca.Certificate.NotAfter) {
+		notAfter = ca.Certificate.NotAfter
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+		Subject:        pkix.Name{CommonName: opts.CommonName},
+		KeyUsage:       keyUsage,
+		ExtKeyUsage:    usages,
+		DNSNames:       dnsNames,
+		IPAddresses:    ips,
+		URIs:           uris,
+		AuthorityKeyId: ca.Certificate.SubjectKeyId,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, pub, ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the certificate: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: CertificateBlockType, Bytes: der}), nil
+}
+
+// SplitSANs sorts SANs into DNS names, IP addresses and URIs.
+func SplitSANs(sans []string) (dnsNames []string, ips []net.IP, uris []*url.URL, err error) {
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			ips = append(ips, ip)
+
+		} else if strings.Contains(san, "://") {
+			u, err := url.Parse(san)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid URI SAN %q: %v", san, err)
+			}
+			uris = append(uris, u)
+
+		} else if san != "" {
+			dnsNames = append(dnsNames, san)
+		}
+	}
+	return
+}
+
+// NewSerial returns a random positive serial number of up to 128 bits.
+func NewSerial() (*big.Int, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), serialBits)
+	max.Sub(max, big.NewInt(1))
+
+	serial, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// subjectKeyID hashes the public key as in RFC 5280, section 4.2.1.2 (1).
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+
+	id := sha1.Sum(info.PublicKey.Bytes)
+	return id[:], nil
+}
+
+// ParseCertificate parses the first certificate of the PEM data.
+func ParseCertificate(crtPEM []byte) (*x509.Certificate, error) {
+	crts, err := ParseCertificates(crtPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(crts) == 0 {
+		return nil, errors.New("no certificate in PEM data")
+	}
+	return crts[0], nil
+}
+
+// ParseCertificates returns the certificates of a PEM bundle.
+func ParseCertificates(data []byte) (crts []*x509.Certificate, err error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return
+		}
+
+		if block.Type != CertificateBlockType {
+			continue
+		}
+
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crts = append(crts, crt)
+	}
+}
+
+// EncodeCertificates returns the PEM bundle of the certificates.
+func EncodeCertificates(crts ...*x509.Certificate) []byte {
+	var data []byte
+	for _, crt := range crts {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: CertificateBlockType, Bytes: crt.Raw})...)
+	}
+	return data
+}
+
+// Verify checks that the certificate chains to one of the roots, for the
+// given usage.
+func Verify(crt *x509.Certificate, roots []*x509.Certificate, usage x509.ExtKeyUsage) error {
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root)
+	}
+
+	_, err := crt.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+// NewCSR returns a PEM certificate signing request for the key.
+func NewCSR(key crypto.Signer, commonName string) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the CSR: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: CSRBlockType, Bytes: der}), nil
+}
+
+// ParseCSR parses a PEM certificate signing request and checks its signature.
+func ParseCSR(csrPEM []byte) (*x509.CertificateRequest, error) {
+	p, _ := pem.Decode(csrPEM)
+	if p == nil {
+		return nil, errors.New("no PEM data in CSR")
+	}
+	if p.Type != CSRBlockType {
+		return nil, fmt.Errorf("wrong CSR type: %s", p.Type)
+	}
+
+	csr, err := x509.ParseCertificateRequest(p.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %v", err)
+	}
+
+	return csr, nil
+}
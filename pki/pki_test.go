@@ -0,0 +1,143 @@
+package pki
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T, name string, validity time.Duration) *CA {
+	t.Helper()
+
+	key, keyPEM, err := GenerateKey(DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crtPEM, err := NewCA(key, Options{CommonName: name, Validity: validity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := LoadCA(crtPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func issue(t *testing.T, ca *CA, opts Options) *x509.Certificate {
+	t.Helper()
+
+	key, _, err := GenerateKey(DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crtPEM, err := ca.Issue(key.Public(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := ParseCertificate(crtPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	ca := newTestCA(t, "ca", 0)
+
+	crt := issue(t, ca, Options{
+		CommonName:   "kgate",
+		SANs:         []string{"kgate", "127.0.0.1"},
+		ExtKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+
+	if err := Verify(crt, []*x509.Certificate{ca.Certificate}, x509.ExtKeyUsageServerAuth); err != nil {
+		t.Fatal("certificate should verify against its CA: ", err)
+	}
+
+	if len(crt.DNSNames) != 1 || crt.DNSNames[0] != "kgate" || len(crt.IPAddresses) != 1 {
+		t.Errorf("wrong SANs: %v %v", crt.DNSNames, crt.IPAddresses)
+	}
+}
+
+func TestVerifyOtherCA(t *testing.T) {
+	ca := newTestCA(t, "ca", 0)
+	other := newTestCA(t, "other", 0)
+
+	crt := issue(t, other, Options{CommonName: "alice"})
+
+	if err := Verify(crt, []*x509.Certificate{ca.Certificate}, x509.ExtKeyUsageClientAuth); err == nil {
+		t.Fatal("certificate from another CA should be rejected")
+	}
+}
+
+func TestVerifyWrongUsage(t *testing.T) {
+	ca := newTestCA(t, "ca", 0)
+
+	crt := issue(t, ca, Options{
+		CommonName:   "alice",
+		SANs:         []string{"kgate"},
+		ExtKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	if err := Verify(crt, []*x509.Certificate{ca.Certificate}, x509.ExtKeyUsageClientAuth); err != nil {
+		t.Fatal("client certificate should verify for client auth: ", err)
+	}
+	if err := Verify(crt, []*x509.Certificate{ca.Certificate}, x509.ExtKeyUsageServerAuth); err == nil {
+		t.Fatal("client certificate should be rejected for server auth")
+	}
+}
+
+func TestIssueCappedByCA(t *testing.T) {
+	ca := newTestCA(t, "ca", time.Hour)
+
+	crt := issue(t, ca, Options{CommonName: "alice", Validity: 24 * time.Hour})
+
+	if !crt.NotAfter.Equal(ca.Certificate.NotAfter) {
+		t.Errorf("certificate should expire with the CA: %v != %v", crt.NotAfter, ca.Certificate.NotAfter)
+	}
+}
+
+func TestVerifyRollover(t *testing.T) {
+	oldCA := newTestCA(t, "old", 0)
+	newCA := newTestCA(t, "new", 0)
+
+	// the CA bundle during a rollover
+	roots, err := ParseCertificates(EncodeCertificates(newCA.Certificate, oldCA.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 {
+		t.Fatalf("expected 2 certificates in the bundle, got %d", len(roots))
+	}
+
+	for _, ca := range []*CA{oldCA, newCA} {
+		crt := issue(t, ca, Options{CommonName: "alice"})
+		if err := Verify(crt, roots, x509.ExtKeyUsageClientAuth); err != nil {
+			t.Errorf("certificate from %s CA should verify against the bundle: %v", ca.Certificate.Subject.CommonName, err)
+		}
+	}
+
+	crt := issue(t, newTestCA(t, "other", 0), Options{CommonName: "alice"})
+	if err := Verify(crt, roots, x509.ExtKeyUsageClientAuth); err == nil {
+		t.Error("certificate from another CA should be rejected by the bundle")
+	}
+}
+
+func TestParseInvalidPEM(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("garbage")} {
+		if _, err := ParsePrivateKey(data); err == nil {
+			t.Errorf("ParsePrivateKey(%q) should fail", data)
+		}
+		if _, err := ParseCertificate(data); err == nil {
+			t.Errorf("ParseCertificate(%q) should fail", data)
+		}
+		if _, err := LoadCA(data, data); err == nil {
+			t.Errorf("LoadCA(%q) should fail", data)
+		}
+	}
+}
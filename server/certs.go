@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/mcluseau/kgate/common"
+	"github.com/mcluseau/kgate/logging"
+	"github.com/mcluseau/kgate/pki"
+)
+
+var (
+	certCheckInterval = 10 * time.Second
+
+	certsMutex = sync.Mutex{}
+	certsData  [][]byte
+)
+
+// loadCertificates reads the certificate, key and CA files. The CA file may
+// hold several certificates, all trusted, for a CA rollover.
+func loadCertificates() (changed bool, err error) {
+	data := make([][]byte, 3)
+	for i, file := range []string{certFile, keyFile, caCertFile} {
+		if data[i], err = ioutil.ReadFile(file); err != nil {
+			return false, err
+		}
+	}
+
+	certsMutex.Lock()
+	defer certsMutex.Unlock()
+
+	if certsData != nil && bytes.Equal(data[0], certsData[0]) &&
+		bytes.Equal(data[1], certsData[1]) && bytes.Equal(data[2], certsData[2]) {
+		return false, nil
+	}
+
+	crt, err := tls.X509KeyPair(data[0], data[1])
+	if err != nil {
+		return false, err
+	}
+
+	leaf, err := x509.ParseCertificate(crt.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+
+	cas, err := pki.ParseCertificates(data[2])
+	if err != nil {
+		return false, err
+	}
+	if len(cas) == 0 {
+		return false, errors.New("no CA certificate in " + caCertFile)
+	}
+
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+
+	crts = []tls.Certificate{crt}
+	rootCAs = pool
+	certsData = data
+
+	common.SetCertificates("server", leaf)
+	common.SetCertificates("ca", cas...)
+
+	return true, nil
+}
+
+// watchCertificates reloads the certificate files when they change, so
+// rotated certificates are used without a restart.
+func watchCertificates() {
+	for range time.Tick(certCheckInterval) {
+		changed, err := loadCertificates()
+		if err != nil {
+			logging.Error("failed to reload certificates", "error", err)
+			continue
+		}
+
+		if changed {
+			logging.Info("certificates reloaded")
+		}
+	}
+}
+
+func currentCertificates() ([]tls.Certificate, *x509.CertPool) {
+	certsMutex.Lock()
+	defer certsMutex.Unlock()
+
+	return crts, rootCAs
+}
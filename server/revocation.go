@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/mcluseau/kgate/logging"
+)
+
+var (
+	revokedFile          = ""
+	revokedCheckInterval = 10 * time.Second
+
+	revokedMutex = sync.Mutex{}
+	revoked      = map[string]bool{}
+	revokedData  []byte
+
+	// live sessions, with the serial of their client certificate
+	liveSessions = map[*yamux.Session]string{}
+)
+
+// loadRevoked reads the revoked serials file: one hexadecimal serial per
+// line, with # comments. A missing file revokes nothing.
+func loadRevoked() (changed bool, err error) {
+	data, err := ioutil.ReadFile(revokedFile)
+	if os.IsNotExist(err) {
+		data, err = nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+
+	if revokedData != nil && bytes.Equal(data, revokedData) {
+		return false, nil
+	}
+
+	serials := map[string]bool{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		serial, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(line), "0x"), 16)
+		if !ok {
+			return false, errors.New("invalid serial: " + line)
+		}
+
+		serials[serial.Text(16)] = true
+	}
+
+	revoked = serials
+	revokedData = data
+
+	if data == nil {
+		// keep a non-nil value so an absent file counts as loaded
+		revokedData = []byte{}
+	}
+
+	return true, nil
+}
+
+// watchRevoked reloads the revoked serials when the file changes, and closes
+// the sessions of newly revoked certificates.
+func watchRevoked() {
+	for range time.Tick(revokedCheckInterval) {
+		changed, err := loadRevoked()
+		if err != nil {
+			logging.Error("failed to reload revoked serials", "file", revokedFile, "error", err)
+			continue
+		}
+
+		if !changed {
+			continue
+		}
+
+		revokedMutex.Lock()
+		logging.Info("revoked serials reloaded", "file", revokedFile, "count", len(revoked))
+		for session, serial := range liveSessions {
+			if revoked[serial] {
+				logging.Warn("closing session of a revoked certificate", "serial", serial)
+				session.Close()
+			}
+		}
+		revokedMutex.Unlock()
+	}
+}
+
+func isRevoked(serial *big.Int) bool {
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+
+	return revoked[serial.Text(16)]
+}
+
+// verifyNotRevoked is the VerifyPeerCertificate hook of the TLS config.
+func verifyNotRevoked(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		if len(chain) != 0 && isRevoked(chain[0].SerialNumber) {
+			return errors.New("certificate revoked")
+		}
+	}
+	return nil
+}
+
+// trackSession records a live session, closing it if its certificate was
+// revoked since the handshake.
+func trackSession(session *yamux.Session, serial *big.Int) {
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+
+	liveSessions[session] = serial.Text(16)
+
+	if revoked[serial.Text(16)] {
+		session.Close()
+	}
+}
+
+func untrackSession(session *yamux.Session) {
+	revokedMutex.Lock()
+	delete(liveSessions, session)
+	revokedMutex.Unlock()
+}
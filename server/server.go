@@ -3,8 +3,7 @@ package server
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"io/ioutil"
-	"log"
+	"encoding/json"
 	"net"
 	"net/http"
 
@@ -13,17 +12,20 @@ import (
 	"golang.org/x/net/websocket"
 
 	"github.com/mcluseau/kgate/common"
+	"github.com/mcluseau/kgate/logging"
 )
 
 var (
-	httpBindSpec = "127.0.0.1:1081"
+	httpBindSpec     = "127.0.0.1:1081"
+	tlsBindSpec      = ""
+	internalBindSpec = "127.0.0.1:1082"
 
 	certFile,
 	keyFile,
 	caCertFile string
 
 	crts    []tls.Certificate
-	rootCAs = x509.NewCertPool()
+	rootCAs *x509.CertPool
 
 	remote *yamux.Session
 )
@@ -36,35 +38,105 @@ func Command() *cobra.Command {
 
 	flags := cmd.Flags()
 	flags.StringVar(&httpBindSpec, "http", httpBindSpec, "HTTP listen spec")
+	flags.StringVar(&tlsBindSpec, "tls", tlsBindSpec, "Raw TLS listen spec (without websocket), disabled if empty")
+	flags.StringVar(&internalBindSpec, "internal", internalBindSpec, "Internal HTTP listen spec for /healthz, /status and /metrics, not to be exposed, disabled if empty")
 	flags.StringVar(&certFile, "crt", "server.crt", "Certificate file")
 	flags.StringVar(&keyFile, "key", "server.key", "Key file")
 	flags.StringVar(&caCertFile, "ca", "ca.crt", "CA certificate file")
+	flags.StringVar(&revokedFile, "revoked", revokedFile, "File of revoked client certificate serials (hexadecimal, one per line), reloaded on change")
+	flags.StringVar(&clientTransfersDir, "client-transfers", clientTransfersDir, "Directory of the local transfers pushed to the clients (transfers.json for all, client.<name>.json for one), reloaded on change")
 	common.RegisterFlags(flags)
+	common.RegisterCertificateFlags(flags)
 
 	return cmd
 }
 
 func run(cmd *cobra.Command, args []string) {
-	{
-		crt, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			log.Fatal("Failed to load X509 key/crt: ", err)
-		}
-		crts = []tls.Certificate{crt}
+	if _, err := loadCertificates(); err != nil {
+		logging.Fatal("failed to load certificates", "error", err)
+	}
+	go watchCertificates()
+	common.StartExpiryChecks()
 
-		caBytes, err := ioutil.ReadFile(caCertFile)
-		if err != nil {
-			log.Fatal("Failed to read CA certificate: ", err)
+	if revokedFile != "" {
+		if _, err := loadRevoked(); err != nil {
+			logging.Fatal("failed to load revoked serials", "file", revokedFile, "error", err)
 		}
-		if !rootCAs.AppendCertsFromPEM(caBytes) {
-			log.Fatal("Failed to parse CA certificate.")
+		go watchRevoked()
+	}
+
+	if clientTransfersDir != "" {
+		if _, err := loadClientTransfers(); err != nil {
+			logging.Fatal("failed to load client transfers", "dir", clientTransfersDir, "error", err)
 		}
+		go watchClientTransfers()
 	}
 
 	common.StartListeners()
 
-	log.Print("Listening on ", httpBindSpec)
-	log.Fatal(http.ListenAndServe(httpBindSpec, websocket.Handler(handleWS)))
+	if tlsBindSpec != "" {
+		go serveTLS()
+	}
+
+	if internalBindSpec != "" {
+		go serveInternal()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", websocket.Handler(handleWS))
+
+	logging.Info("listening", "listener", httpBindSpec)
+	err := http.ListenAndServe(httpBindSpec, mux)
+	logging.Fatal("HTTP server failed", "error", err)
+}
+
+// serveInternal serves the endpoints kept out of the gateway's port, which
+// is exposed to the clients.
+func serveInternal() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		common.WriteMetrics(w)
+	})
+
+	logging.Info("internal HTTP listening", "listener", internalBindSpec)
+	err := http.ListenAndServe(internalBindSpec, mux)
+	logging.Fatal("internal HTTP server failed", "error", err)
+}
+
+// handleStatus tells if a client is connected.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session":   common.Session(),
+		"sessions":  common.Sessions(),
+		"listeners": len(common.Listeners()),
+		"streams":   len(common.Streams()),
+	})
+}
+
+// serveTLS accepts clients connecting directly over TLS, for exposure through
+// a load balancer or a node port.
+func serveTLS() {
+	l, err := common.Listen(tlsBindSpec, "")
+	if err != nil {
+		logging.Fatal("failed to listen", "listener", tlsBindSpec, "error", err)
+	}
+
+	logging.Info("listening for raw TLS", "listener", tlsBindSpec)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			logging.Fatal("raw TLS listener failed", "error", err)
+		}
+
+		go handleConnection(conn)
+	}
 }
 
 func handleWS(ws *websocket.Conn) {
@@ -74,17 +146,44 @@ func handleWS(ws *websocket.Conn) {
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	crts, rootCAs := currentCertificates()
+
 	safeConn := tls.Server(conn, &tls.Config{
 		Certificates: crts,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		ClientCAs:    rootCAs,
+		NextProtos:   []string{common.HeaderProtocol},
+
+		VerifyPeerCertificate: verifyNotRevoked,
 	})
 
+	if err := safeConn.Handshake(); err != nil {
+		logging.Warn("TLS handshake failed", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+
+	peerCert := safeConn.ConnectionState().PeerCertificates[0]
+	peer := peerCert.Subject.CommonName
+
 	session, err := yamux.Server(safeConn, nil)
 	if err != nil {
-		log.Print("yamu.Server() failed: ", err)
+		logging.Error("yamux server failed", "peer", peer, "error", err)
 		return
 	}
 
-	common.ManageSession(session)
+	trackSession(session, peerCert.SerialNumber)
+	defer untrackSession(session)
+
+	common.SetCertificates("client/"+peer, peerCert)
+	defer common.SetCertificates("client/" + peer)
+
+	protocol := safeConn.ConnectionState().NegotiatedProtocol
+
+	if protocol == common.HeaderProtocol {
+		// older clients don't know the control stream
+		startPush(session, peer)
+		defer stopPush(session)
+	}
+
+	common.ManageSession(session, peer, protocol)
 }
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/mcluseau/kgate/common"
+	"github.com/mcluseau/kgate/config"
+	"github.com/mcluseau/kgate/logging"
+)
+
+const (
+	// standardTransfersFile holds the transfers pushed to every client.
+	standardTransfersFile = "transfers.json"
+
+	// clientTransfersPrefix and clientTransfersSuffix frame the file of the
+	// transfers pushed to a single client, like client.alice.json.
+	clientTransfersPrefix = "client."
+	clientTransfersSuffix = ".json"
+
+	clientTransfersCheckInterval = 10 * time.Second
+
+	pushTimeout = 10 * time.Second
+)
+
+var (
+	clientTransfersDir = ""
+
+	clientTransfersMutex = sync.Mutex{}
+	clientTransfersData  map[string][]byte
+
+	// sessions receiving the client transfers
+	pushSessions = map[*yamux.Session]*pushSession{}
+)
+
+type pushSession struct {
+	peer   string
+	stream net.Conn
+
+	// mutex serializes the pushes to the session
+	mutex sync.Mutex
+	last  []byte
+}
+
+// loadClientTransfers reads the transfers directory (a mounted config map).
+func loadClientTransfers() (changed bool, err error) {
+	files, err := ioutil.ReadDir(clientTransfersDir)
+	if os.IsNotExist(err) {
+		files, err = nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	data := map[string][]byte{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, clientTransfersSuffix) {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(clientTransfersDir, name))
+		if err != nil {
+			return false, err
+		}
+
+		if len(bytes.TrimSpace(content)) != 0 {
+			if err := json.Unmarshal(content, &config.Config{}); err != nil {
+				return false, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+
+		data[name] = content
+	}
+
+	clientTransfersMutex.Lock()
+	defer clientTransfersMutex.Unlock()
+
+	if clientTransfersData != nil && reflect.DeepEqual(data, clientTransfersData) {
+		return false, nil
+	}
+
+	clientTransfersData = data
+	return true, nil
+}
+
+// watchClientTransfers reloads the transfers when they change, and pushes
+// them to the clients.
+func watchClientTransfers() {
+	for range time.Tick(clientTransfersCheckInterval) {
+		changed, err := loadClientTransfers()
+		if err != nil {
+			logging.Error("failed to reload client transfers", "dir", clientTransfersDir, "error", err)
+			continue
+		}
+
+		if !changed {
+			continue
+		}
+
+		logging.Info("client transfers reloaded", "dir", clientTransfersDir)
+
+		for session, ps := range pushSessionsSnapshot() {
+			pushTransfers(session, ps)
+		}
+	}
+}
+
+// pushSessionsSnapshot returns the sessions receiving the client transfers,
+// so they're pushed without holding clientTransfersMutex.
+func pushSessionsSnapshot() map[*yamux.Session]*pushSession {
+	clientTransfersMutex.Lock()
+	defer clientTransfersMutex.Unlock()
+
+	sessions := make(map[*yamux.Session]*pushSession, len(pushSessions))
+	for session, ps := range pushSessions {
+		sessions[session] = ps
+	}
+	return sessions
+}
+
+// peerTransfers returns the transfers of a client: the standard ones and its
+// own, its own winning on the same listen spec.
+func peerTransfers(peer string) *common.ControlMessage {
+	clientTransfersMutex.Lock()
+	defer clientTransfersMutex.Unlock()
+
+	cfg := &config.Config{}
+	for _, name := range []string{standardTransfersFile, clientTransfersPrefix + peer + clientTransfersSuffix} {
+		// checked when loaded
+		json.Unmarshal(clientTransfersData[name], cfg)
+	}
+
+	listeners := common.ConfigListeners(cfg)
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].Listen < listeners[j].Listen })
+
+	return &common.ControlMessage{Transfers: listeners}
+}
+
+// startPush opens the control stream of the session and sends the client its
+// transfers.
+func startPush(session *yamux.Session, peer string) {
+	if clientTransfersDir == "" {
+		return
+	}
+
+	stream, err := common.OpenControl(session)
+	if err != nil {
+		logging.Error("failed to open the control stream", "peer", peer, "error", err)
+		return
+	}
+
+	ps := &pushSession{peer: peer, stream: stream}
+
+	clientTransfersMutex.Lock()
+	pushSessions[session] = ps
+	clientTransfersMutex.Unlock()
+
+	pushTransfers(session, ps)
+}
+
+func stopPush(session *yamux.Session) {
+	clientTransfersMutex.Lock()
+	ps, ok := pushSessions[session]
+	delete(pushSessions, session)
+	clientTransfersMutex.Unlock()
+
+	if ok {
+		// also unblocks a push in progress
+		ps.stream.Close()
+	}
+}
+
+// pushTransfers sends the client's transfers if they changed since the last
+// push.
+func pushTransfers(session *yamux.Session, ps *pushSession) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	msg := peerTransfers(ps.peer)
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		logging.Error("failed to encode client transfers", "peer", ps.peer, "error", err)
+		return
+	}
+
+	if ps.last != nil && bytes.Equal(data, ps.last) {
+		return
+	}
+
+	ps.stream.SetWriteDeadline(time.Now().Add(pushTimeout))
+	if err := common.WriteControl(ps.stream, msg); err != nil {
+		// older clients refuse the control stream
+		logging.Warn("failed to push client transfers", "peer", ps.peer, "error", err)
+		ps.stream.Close()
+
+		clientTransfersMutex.Lock()
+		if pushSessions[session] == ps {
+			delete(pushSessions, session)
+		}
+		clientTransfersMutex.Unlock()
+		return
+	}
+
+	ps.last = data
+	logging.Info("client transfers pushed", "peer", ps.peer, "count", len(msg.Transfers))
+}